@@ -0,0 +1,170 @@
+// Body composition metrics from weight and impedance for Xiaomi Mi Scale 2
+// https://github.com/oliexdev/openScale/blob/master/android_app/app/src/main/java/com/health/openscale/core/bluetooth/lib/MiScaleLib.java
+package body
+
+import (
+	"math"
+)
+
+type Profile struct {
+	Height float64 // cm
+	Age    float64
+	Female bool
+}
+
+// Metrics returns BMI and BMR for any weight (kg) and all other metrics only with valid impedance
+func Metrics(p Profile, weight float64, impedance uint16) map[string]float64 {
+	result := map[string]float64{
+		"bmi": round(p.bmi(weight)),
+		"bmr": round(p.bmr(weight)),
+	}
+
+	// impedance should be in valid range
+	if impedance == 0 || impedance >= 3000 {
+		return result
+	}
+
+	imp := float64(impedance)
+	fat := p.fatPercentage(weight, imp)
+	bone := p.boneMass(weight, imp)
+
+	result["fat"] = round(fat)
+	result["water"] = round(p.waterPercentage(fat))
+	result["bone_mass"] = round(bone)
+	result["muscle_mass"] = round(p.muscleMass(weight, fat, bone))
+	result["visceral_fat"] = round(p.visceralFat(weight))
+	return result
+}
+
+func (p Profile) bmi(weight float64) float64 {
+	return clamp(weight/((p.Height/100)*(p.Height/100)), 10, 90)
+}
+
+func (p Profile) bmr(weight float64) float64 {
+	var bmr float64
+	if p.Female {
+		bmr = 864.6 + weight*10.2036 - p.Height*0.39336 - p.Age*6.204
+	} else {
+		bmr = 877.8 + weight*14.916 - p.Height*0.726 - p.Age*8.976
+	}
+	return clamp(bmr, 500, 10000)
+}
+
+// lbm - lean body mass coefficient
+func (p Profile) lbm(weight, impedance float64) float64 {
+	lbm := (p.Height * 9.058 / 100) * (p.Height / 100)
+	lbm += weight*0.32 + 12.226
+	lbm -= impedance * 0.0068
+	lbm -= p.Age * 0.0542
+	return lbm
+}
+
+func (p Profile) fatPercentage(weight, impedance float64) float64 {
+	c := 0.8
+	if p.Female {
+		if p.Age <= 49 {
+			c = 9.25
+		} else {
+			c = 7.25
+		}
+	}
+
+	coefficient := 1.0
+	switch {
+	case !p.Female && weight < 61:
+		coefficient = 0.98
+	case p.Female && weight > 60:
+		coefficient = 0.96
+		if p.Height > 160 {
+			coefficient *= 1.03
+		}
+	case p.Female && weight < 50:
+		coefficient = 1.02
+		if p.Height > 160 {
+			coefficient *= 1.03
+		}
+	}
+
+	fat := (1.0 - ((p.lbm(weight, impedance)-c)*coefficient)/weight) * 100
+	if fat > 63 {
+		fat = 75
+	}
+	return clamp(fat, 5, 75)
+}
+
+func (p Profile) waterPercentage(fat float64) float64 {
+	water := (100 - fat) * 0.7
+
+	coefficient := 0.98
+	if water <= 50 {
+		coefficient = 1.02
+	}
+	if water*coefficient >= 65 {
+		return 75
+	}
+	return clamp(water*coefficient, 35, 75)
+}
+
+func (p Profile) boneMass(weight, impedance float64) float64 {
+	base := 0.18016894
+	if p.Female {
+		base = 0.245691014
+	}
+
+	bone := (base - p.lbm(weight, impedance)*0.05158) * -1
+	if bone > 2.2 {
+		bone += 0.1
+	} else {
+		bone -= 0.1
+	}
+
+	if (p.Female && bone > 5.1) || (!p.Female && bone > 5.2) {
+		bone = 8
+	}
+	return clamp(bone, 0.5, 8)
+}
+
+func (p Profile) muscleMass(weight, fat, bone float64) float64 {
+	muscle := weight - fat*0.01*weight - bone
+	if (p.Female && muscle >= 84) || (!p.Female && muscle >= 93.5) {
+		muscle = 120
+	}
+	return clamp(muscle, 10, 120)
+}
+
+func (p Profile) visceralFat(weight float64) float64 {
+	var vfal float64
+	if p.Female {
+		if weight > (13-p.Height*0.5)*-1 {
+			subsubcalc := p.Height*1.45 + p.Height*0.1158*p.Height - 120
+			subcalc := weight * 500 / subsubcalc
+			vfal = subcalc - 6 + p.Age*0.07
+		} else {
+			subcalc := 0.691 + p.Height*-0.0024 + p.Height*-0.0024
+			vfal = (p.Height*0.027-subcalc*weight)*-1 + p.Age*0.07 - p.Age
+		}
+	} else {
+		if p.Height < weight*1.6 {
+			subcalc := (p.Height*0.4 - p.Height*(p.Height*0.0826)) * -1
+			vfal = weight*305/(subcalc+48) - 2.9 + p.Age*0.15
+		} else {
+			subcalc := 0.765 + p.Height*-0.0015
+			vfal = (p.Height*0.143-weight*subcalc)*-1 + p.Age*0.15 - 5.0
+		}
+	}
+	return clamp(vfal, 1, 50)
+}
+
+func clamp(value, min, max float64) float64 {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+func round(value float64) float64 {
+	return math.Round(value*100) / 100
+}
@@ -193,7 +193,7 @@ func btchipWriter() {
 	}
 }
 
-var btchipRepeatFilter = RepeatFilter{cache: make(map[string]time.Time), clear: time.Now()}
+var btchipRepeatFilter RepeatFilter
 
 // btchipProcessExtResponse unpack GAP extended scan response from BT chip
 // skips same data for 5 seconds
@@ -219,6 +219,8 @@ func btchipProcessExtResponse(data []byte) int {
 
 	var payload gap.Map
 
+	btchipHandled = false
+
 	switch msg.ServiceUUID {
 	case 0x181A:
 		if payload = gap.ParseATC1441(msg.Raw[0x16][2:]); payload != nil {
@@ -227,14 +229,42 @@ func btchipProcessExtResponse(data []byte) int {
 
 	case 0x181B:
 		if payload = gap.ParseMiScalesV2(msg.Raw[0x16][2:]); payload != nil {
+			bleScalesMetrics(payload)
 			btchipProcessBLE(msg.MAC, "miscales2", payload)
 		}
 
 	case 0x181D:
 		if payload = gap.ParseMiScalesV1(msg.Raw[0x16][2:]); payload != nil {
+			bleScalesMetrics(payload)
 			btchipProcessBLE(msg.MAC, "miscales", payload)
 		}
 
+	case 0x181C, 0x181E, 0xFCD2:
+		payload, event, useful := gap.ParseBTHome(msg.ServiceUUID, msg.MAC, msg.Raw[0x16][2:], config.GetBindkey)
+		if useful > 0 {
+			if useful == 1 {
+				log.Debug().Str("mac", msg.MAC).Msg("BTHome encrypted, bindkey required")
+			}
+			btchipProcessBLE(msg.MAC, "bthome", payload)
+			if event != nil {
+				btchipProcessBLE(msg.MAC, "bthome", event)
+			}
+		}
+
+	case 0xFDCD:
+		b := msg.Raw[0x16][2:]
+		if payload = gap.ParseQingping(b); payload != nil {
+			// second byte is product ID
+			advType := fmt.Sprintf("qingping:%d", b[1])
+			btchipProcessBLE(msg.MAC, advType, payload)
+		}
+
+	case 0xFEAA:
+		btchipProcessEddystone(msg)
+
+	case 0xFD3D, 0x0D00:
+		btchipProcessSwitchBot(msg)
+
 	case 0xFE95:
 		mibeacon, useful := gap.ParseMiBeacon(msg.Raw[0x16][2:], config.GetBindkey)
 		//log.Debug().Uint8("useful", useful).Msgf("%+v", mibeacon)
@@ -245,9 +275,17 @@ func btchipProcessExtResponse(data []byte) int {
 				}
 				// is encrypted
 				miioBleQueryDev(mibeacon.Mac, mibeacon.Pdid)
+			} else if mibeacon.Encrypted && !btchipCheckMiBeaconCounter(mibeacon) {
+				// don't publish skipped advert in raw mode
+				btchipHandled = true
+				break
 			}
 			advType := fmt.Sprintf("mi:%d", mibeacon.Pdid)
-			btchipProcessBLE(msg.MAC, advType, mibeacon.Decode())
+			state, event := mibeacon.Decode()
+			btchipProcessBLE(msg.MAC, advType, state)
+			if event != nil {
+				btchipProcessBLE(msg.MAC, advType, event)
+			}
 		}
 	}
 
@@ -259,15 +297,98 @@ func btchipProcessExtResponse(data []byte) int {
 		}
 	case 0x00D2: // Nut
 		btchipProcessBLETracker(msg.MAC, "nut", msg.RSSI)
+	case 0x0499: // RuuviTag
+		if payload = gap.ParseRuuvi(msg.Raw[0xFF][2:]); payload != nil {
+			btchipProcessBLE(msg.MAC, "ruuvi", payload)
+		}
+	case 0x0969: // SwitchBot
+		// skip if already processed with service data
+		if msg.ServiceUUID != 0xFD3D && msg.ServiceUUID != 0x0D00 {
+			btchipProcessSwitchBot(msg)
+		}
+	case 0xEC88: // Govee H5072, H5075, H5051, H5074
+		if payload = gap.ParseGoveeH5075(msg.Raw[0xFF][2:]); payload != nil {
+			btchipProcessBLE(msg.MAC, "govee5075", payload)
+		} else if payload = gap.ParseGoveeH5074(msg.Raw[0xFF][2:]); payload != nil {
+			btchipProcessBLE(msg.MAC, "govee5074", payload)
+		}
+	case 0x0001: // Govee H5101, H5102, H5177
+		if payload = gap.ParseGoveeH5101(msg.Raw[0xFF][2:]); payload != nil {
+			btchipProcessBLE(msg.MAC, "govee5101", payload)
+		}
+	case 0x8801: // Govee H5179
+		if payload = gap.ParseGoveeH5179(msg.Raw[0xFF][2:]); payload != nil {
+			btchipProcessBLE(msg.MAC, "govee5179", payload)
+		}
 	case 0x0157: // MiBand or Amazfit Watch
 		// don't know how to parse payload, but can be used as tracker
 		btchipProcessBLETracker(msg.MAC, "miband", msg.RSSI)
 	}
 
+	if !btchipHandled {
+		if raw := config.GetRaw(); raw != nil && raw.Enabled {
+			btchipProcessRaw(msg, raw)
+		}
+	}
+
 	return n
 }
 
+// MiBeacon MAC to last encryption counter, protects from replayed adverts,
+// last counters are kept in devices snapshot
+var btchipMiBeaconCounters = make(map[string]btchipMiBeaconCounter)
+
+type btchipMiBeaconCounter struct {
+	counter uint32
+	reset   uint32 // counter after large backward jump, waits for confirmation
+	pending bool
+}
+
+// total count of rejected adverts for gateway state
+var btchipMiBeaconRejected int
+
+const (
+	// backward jump of counter larger than this can be device reset
+	btchipMiBeaconResetJump = 10000
+	// device reset is confirmed by the next counter in this window
+	btchipMiBeaconResetWindow = 100
+)
+
+// btchipCheckMiBeaconCounter returns false for stale or repeated encryption counter
+func btchipCheckMiBeaconCounter(mibeacon *gap.MiBeacon) bool {
+	counter := mibeacon.Counter
+	last, ok := btchipMiBeaconCounters[mibeacon.Mac]
+	switch {
+	case !ok || counter > last.counter:
+	case counter == last.counter:
+		// same advert repeated by device
+		return false
+	case last.pending && counter > last.reset && counter-last.reset <= btchipMiBeaconResetWindow:
+		log.Info().Str("mac", mibeacon.Mac).Uint32("counter", counter).
+			Uint32("last", last.counter).Msg("MiBeacon counter reset")
+	default:
+		if last.counter-counter > btchipMiBeaconResetJump {
+			// accept reset only if the next advert continues from this counter
+			last.reset, last.pending = counter, true
+			btchipMiBeaconCounters[mibeacon.Mac] = last
+		}
+		btchipMiBeaconRejected++
+		log.WithLevel(btskip).Str("mac", mibeacon.Mac).Uint32("counter", counter).
+			Uint32("last", last.counter).Int("rejected", btchipMiBeaconRejected).
+			Msg("Skip replayed MiBeacon")
+		gw.updateMiBeaconRejected(btchipMiBeaconRejected)
+		return false
+	}
+	btchipMiBeaconCounters[mibeacon.Mac] = btchipMiBeaconCounter{counter: counter}
+	return true
+}
+
+// btchipHandled is true if current advertisement was processed by any parser
+var btchipHandled bool
+
 func btchipProcessBLE(mac string, advType string, data gap.Map) {
+	btchipHandled = true
+
 	device, ok := devices[mac]
 	if !ok {
 		device = newBLEDevice(mac, advType)
@@ -280,6 +401,8 @@ func btchipProcessBLE(mac string, advType string, data gap.Map) {
 var btchipTrackers = make(map[string]uint8)
 
 func btchipProcessBLETracker(mac string, advType string, rssi int8) {
+	btchipHandled = true
+
 	// detects tracker only after 10 events
 	if _, ok := btchipTrackers[mac]; !ok {
 		btchipTrackers[mac] = 1
@@ -298,29 +421,152 @@ func btchipProcessBLETracker(mac string, advType string, rssi int8) {
 	device.(*BLEDevice).updateState(data)
 }
 
+// MAC to time of next allowed raw message
+var btchipRawTimers Deadlines
+
+// btchipProcessRaw publishes unhandled advertisement to MQTT for new devices research
+func btchipProcessRaw(msg *gap.Message, raw *ConfigRaw) {
+	if !raw.Test(msg.MAC, msg.ServiceUUID, msg.CompanyID) {
+		return
+	}
+
+	if raw.Interval > 0 {
+		now := time.Now()
+		btchipRawTimers.Prune(now, nil)
+		if btchipRawTimers.Test(msg.MAC, now) {
+			return
+		}
+		btchipRawTimers.Set(msg.MAC, now.Add(time.Duration(raw.Interval)*time.Second))
+	}
+
+	mqttPublish(mqttTopic(msg.MAC, "raw"), msg, false)
+}
+
+// Eddystone beacon MAC to UID tracker ID, because TLM and URL frames don't have UID
+var btchipEddystone = make(map[string]string)
+
+// beacons without UID frames for this time are removed from btchipEddystone
+const btchipEddystoneTimeout = 10 * time.Minute
+
+var btchipEddystoneTimers Deadlines
+
+func btchipProcessEddystone(msg *gap.Message) {
+	b := msg.Raw[0x16][2:]
+
+	if payload := gap.ParseEddystoneUID(b); payload != nil {
+		id := fmt.Sprintf("%s-%s", payload["namespace"], payload["instance"])
+		btchipEddystone[msg.MAC] = id
+		btchipProcessBLETracker(id, "eddystone", msg.RSSI)
+
+		now := time.Now()
+		btchipEddystoneTimers.Set(msg.MAC, now.Add(btchipEddystoneTimeout))
+		btchipEddystoneTimers.Prune(now, func(mac string) {
+			delete(btchipEddystone, mac)
+		})
+		return
+	}
+
+	id, ok := btchipEddystone[msg.MAC]
+
+	// EID frames change identifier periodically and can't be used as tracker,
+	// beacons with EID frames only are published by MAC
+	if payload := gap.ParseEddystoneEID(b); payload != nil {
+		if ok {
+			btchipProcessBLE(id, "eddystone", payload)
+		} else {
+			btchipProcessBLE(msg.MAC, "eddystone", payload)
+		}
+		return
+	}
+
+	// skip frames until UID frame from the same MAC, so telemetry goes to
+	// the same device as tracker
+	if !ok {
+		return
+	}
+
+	if payload := gap.ParseEddystoneTLM(b); payload != nil {
+		btchipProcessBLE(id, "eddystone", payload)
+	} else if payload = gap.ParseEddystoneURL(b); payload != nil {
+		btchipProcessBLE(id, "eddystone", gap.Map{"url": payload["url"]})
+	}
+}
+
+// SwitchBot MAC to device type, because manufacturer data doesn't have it
+var btchipSwitchBot = make(map[string]byte)
+
+func btchipProcessSwitchBot(msg *gap.Message) {
+	var service, manufacturer []byte
+	if msg.ServiceUUID == 0xFD3D || msg.ServiceUUID == 0x0D00 {
+		service = msg.Raw[0x16][2:]
+	}
+	if msg.CompanyID == 0x0969 {
+		manufacturer = msg.Raw[0xFF][2:]
+	}
+
+	model := gap.SwitchBotModel(service)
+	if model != 0 {
+		btchipSwitchBot[msg.MAC] = model
+	} else if model = btchipSwitchBot[msg.MAC]; model == 0 {
+		return
+	}
+
+	if payload := gap.ParseSwitchBot(model, service, manufacturer); payload != nil {
+		advType := fmt.Sprintf("switchbot:%c", model)
+		btchipProcessBLE(msg.MAC, advType, payload)
+	}
+}
+
 type RepeatFilter struct {
-	cache map[string]time.Time
-	clear time.Time
+	cache Deadlines
 }
 
 func (r *RepeatFilter) Test(key string) bool {
 	now := time.Now()
-	if r.clear.After(now) {
-		for k, v := range r.cache {
-			if now.After(v) {
-				delete(r.cache, k)
-			}
-		}
-		// clear cache once per minute
-		r.clear = now.Add(time.Minute)
-	}
+	r.cache.Prune(now, nil)
 
-	if ts, ok := r.cache[key]; ok && now.Before(ts) {
+	if r.cache.Test(key, now) {
 		return true
 	}
 
 	// put key in cache on 5 seconds
-	r.cache[key] = now.Add(time.Second * 5)
+	r.cache.Set(key, now.Add(time.Second*5))
 
 	return false
 }
+
+// Deadlines keeps expiration time of keys and removes expired keys once per minute
+type Deadlines struct {
+	items map[string]time.Time
+	clear time.Time
+}
+
+// Test returns true if the key is not expired
+func (d *Deadlines) Test(key string, now time.Time) bool {
+	ts, ok := d.items[key]
+	return ok && now.Before(ts)
+}
+
+func (d *Deadlines) Set(key string, ts time.Time) {
+	if d.items == nil {
+		d.items = make(map[string]time.Time)
+	}
+	d.items[key] = ts
+}
+
+// Prune removes expired keys not more than once per minute, remove is called
+// for each of them if not nil
+func (d *Deadlines) Prune(now time.Time, remove func(key string)) {
+	if now.Before(d.clear) {
+		return
+	}
+	for k, ts := range d.items {
+		if now.After(ts) {
+			delete(d.items, k)
+			if remove != nil {
+				remove(k)
+			}
+		}
+	}
+	d.clear = now.Add(time.Minute)
+}
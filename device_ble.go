@@ -1,9 +1,13 @@
 package main
 
 import (
+	"github.com/AlexxIT/gw3/body"
 	"github.com/AlexxIT/gw3/dict"
 	"github.com/AlexxIT/gw3/gap"
 	"github.com/rs/zerolog/log"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type BLEDevice struct {
@@ -13,13 +17,57 @@ type BLEDevice struct {
 	Model string `json:"model"`
 	MAC   string `json:"mac"`
 	state gap.Map
+
+	// state keys with published Home Assistant discovery
+	discovered        map[string]bool
+	discoveredSession int32
+
+	lastSeen  int64 // unix time, atomic
+	available int32 // availability state, atomic
+}
+
+const (
+	AvailabilityUnknown = iota
+	AvailabilityOnline
+	AvailabilityOffline
+)
+
+// devicesMu guards devices map from readers outside of BT chip goroutine
+var devicesMu sync.RWMutex
+
+func getDevice(mac string) (interface{}, bool) {
+	devicesMu.RLock()
+	device, ok := devices[mac]
+	devicesMu.RUnlock()
+	return device, ok
 }
 
 var brands = []string{
 	"atc1441", "Xiaomi", "TH Sensor ATC", "ATC1441",
 	"miscales", "Xiaomi", "Mi Scale", "XMTZC01HM",
 	"miscales2", "Xiaomi", "Mi Scale 2", "XMTZC04HM",
+	"bthome", "BTHome", "BTHome Sensor", "BTHome",
+	"govee5074", "Govee", "TH Sensor", "H5074",
+	"govee5075", "Govee", "TH Sensor", "H5072/H5075",
+	"govee5101", "Govee", "TH Sensor", "H5101/H5102/H5177",
+	"govee5179", "Govee", "TH Sensor", "H5179",
+	"ruuvi", "Ruuvi", "RuuviTag", "RuuviTag",
+	"qingping:1", "Qingping", "TH Sensor", "CGG1",
+	"qingping:7", "Qingping", "TH Sensor", "CGG1",
+	"qingping:9", "Qingping", "TH Barometer", "CGP1W",
+	"qingping:12", "Qingping", "Alarm Clock", "CGD1",
+	"qingping:14", "Qingping", "Air Monitor Lite", "CGDN1",
+	"qingping:16", "Qingping", "TH Lite", "CGDK2",
+	"qingping:18", "Qingping", "Motion Sensor", "CGPR1",
+	"switchbot:H", "SwitchBot", "Bot", "WoHand",
+	"switchbot:T", "SwitchBot", "Meter", "WoSensorTH",
+	"switchbot:i", "SwitchBot", "Meter Plus", "WoSensorTHP",
+	"switchbot:w", "SwitchBot", "Outdoor Meter", "WoIOSensorTH",
+	"switchbot:d", "SwitchBot", "Contact Sensor", "WoContact",
+	"switchbot:s", "SwitchBot", "Motion Sensor", "WoPresence",
+	"switchbot:c", "SwitchBot", "Curtain", "WoCurtain",
 	"ibeacon", "Apple", "iBeacon", "Tracker",
+	"eddystone", "Google", "Eddystone", "Tracker",
 	"nut", "NutFind", "Nut", "Tracker",
 	"miband", "Xiaomi", "Mi Band", "Tracker",
 	"mi:152", "Xiaomi", "Flower Care", "HHCCJCY01",
@@ -59,12 +107,18 @@ var brands = []string{
 	"mi:2691", "Xiaomi", "Qingping Motion Sensor", "CGPR1",
 	"mi:2701", "Xiaomi", "Motion Sensor 2", "RTCGQ02LM", // 15,4119,4120
 	"mi:2888", "Xiaomi", "Qingping TH Sensor", "CGG1", // same model as 839?!
+	"mi:4611", "Xiaomi", "TH Sensor", "XMWSDJ04MMC", // 19457,19458,18435
+	"mi:7849", "Linptech", "Wireless Button", "K9B-1BTN", // 19980,19981,19982
+	"mi:7850", "Linptech", "Wireless Button", "K9B-2BTN",
+	"mi:7851", "Linptech", "Wireless Button", "K9B-3BTN",
+	"mi:13617", "Xiaomi", "Motion Sensor 2S", "XMPIRO2SXS", // 18952,18456,18457
 }
 
 func newBLEDevice(mac string, advType string) *BLEDevice {
 	device := &BLEDevice{
-		Type: "ble",
-		MAC:  mac,
+		Type:     "ble",
+		MAC:      mac,
+		lastSeen: time.Now().Unix(),
 	}
 
 	for i := 0; i < len(brands); i += 4 {
@@ -80,14 +134,24 @@ func newBLEDevice(mac string, advType string) *BLEDevice {
 		device.Model = advType
 	}
 
+	devicesMu.Lock()
 	devices[mac] = device
-	mqttPublish("gw3/"+mac+"/info", device, true)
+	devicesMu.Unlock()
+
+	mqttPublish(mqttTopic(mac, "info"), device, true)
+	hassPublishBLE(device)
 	return device
 }
 
 func (d *BLEDevice) updateState(data gap.Map) {
+	now := time.Now().Unix()
+	atomic.StoreInt64(&d.lastSeen, now)
+	if atomic.SwapInt32(&d.available, AvailabilityOnline) != AvailabilityOnline {
+		mqttPublish(mqttTopic(d.MAC, "availability"), "online", true)
+	}
+
 	if data.IsEvent() {
-		mqttPublish("gw3/"+d.MAC+"/event", data, false)
+		mqttPublish(mqttTopic(d.MAC, "event"), data, false)
 		return
 	}
 
@@ -98,7 +162,11 @@ func (d *BLEDevice) updateState(data gap.Map) {
 	} else {
 		d.state = data
 	}
-	mqttPublish("gw3/"+d.MAC+"/state", d.state, true)
+	d.state["last_seen"] = now
+	hassPublishBLE(d)
+	mqttPublish(mqttTopic(d.MAC, "state"), d.state, true)
+
+	bleSaveDevices()
 }
 
 func (d *BLEDevice) getState() {
@@ -115,3 +183,77 @@ func (d *BLEDevice) setState(p []byte) {
 		config.SetBindKey(d.MAC, value)
 	}
 }
+
+// bleAvailabilityChecker marks devices offline after timeout without any data
+func bleAvailabilityChecker() {
+	for range time.Tick(30 * time.Second) {
+		now := time.Now()
+		stale := 0
+
+		devicesMu.RLock()
+		for _, device := range devices {
+			d, ok := device.(*BLEDevice)
+			if !ok {
+				continue
+			}
+
+			available := atomic.LoadInt32(&d.available)
+			if available == AvailabilityOffline {
+				stale++
+				continue
+			}
+
+			timeout := config.GetTimeout(d.MAC, d.Model)
+			if timeout == 0 {
+				continue
+			}
+
+			lastSeen := time.Unix(atomic.LoadInt64(&d.lastSeen), 0)
+			if now.Sub(lastSeen) < timeout {
+				continue
+			}
+
+			// also restored from snapshot or created without data devices
+			if atomic.CompareAndSwapInt32(&d.available, available, AvailabilityOffline) {
+				log.Info().Str("mac", d.MAC).Time("last_seen", lastSeen).Msg("Device offline")
+				mqttPublish(mqttTopic(d.MAC, "availability"), "offline", true)
+				stale++
+			}
+		}
+		devicesMu.RUnlock()
+
+		gw.updateStale(stale)
+	}
+}
+
+// bleScalesMetrics adds user name and body composition metrics to stabilized weighing
+func bleScalesMetrics(data gap.Map) {
+	if data["stabilized"] != true || data["removed"] == true {
+		return
+	}
+
+	var weight float64
+	if v, ok := data["weight_kg"].(float32); ok {
+		weight = float64(v)
+	} else if v, ok = data["weight_lb"].(float32); ok {
+		weight = float64(v) * 0.45359237
+	} else if v, ok = data["weight"].(float32); ok {
+		// jin (catty) = 0.5 kg
+		weight = float64(v) / 2
+	} else {
+		return
+	}
+
+	user := config.GetUser(weight)
+	if user == nil {
+		return
+	}
+
+	data["user"] = user.Name
+
+	impedance, _ := data["impedance"].(uint16)
+	profile := body.Profile{Height: user.Height, Age: user.Age, Female: user.Sex == "female"}
+	for k, v := range body.Metrics(profile, weight, impedance) {
+		data[k] = v
+	}
+}
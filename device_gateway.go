@@ -1,9 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"github.com/AlexxIT/gw3/dict"
 	"github.com/rs/zerolog/log"
+	"sync"
 )
 
 type GatewayDevice struct {
@@ -26,6 +28,10 @@ type GatewayDevice struct {
 	} `json:"bt"`
 	state      dict.Dict
 	alarmState string
+
+	// guards info, state and publishing order from BT chip, miio, MQTT and
+	// availability goroutines
+	mu sync.Mutex
 }
 
 func newGatewayDevice() *GatewayDevice {
@@ -36,24 +42,68 @@ func newGatewayDevice() *GatewayDevice {
 	device.Miio.Did = did
 	device.WiFi.MAC = mac
 	devices[mac] = device
-	mqttPublish("gw3/"+mac+"/info", device, true)
 	return device
 }
 
 func (d *GatewayDevice) updateInfo() {
-	mqttPublish("gw3/"+d.WiFi.MAC+"/info", d, true)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	mqttPublish(mqttTopic(d.WiFi.MAC, "info"), d, true)
+	hassPublishGateway(d)
 }
 
 func (d *GatewayDevice) updateState(state string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
 	// skip same state
 	if d.state["state"] == state {
 		return
 	}
 	d.state["state"] = state
-	mqttPublish("gw3/"+d.WiFi.MAC+"/state", d.state, true)
+	mqttPublish(mqttTopic(d.WiFi.MAC, "state"), d.state, true)
+}
+
+// updateStale publish count of BLE devices without data longer than offline timeout
+func (d *GatewayDevice) updateStale(count int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// skip same state
+	if d.state["stale"] == count {
+		return
+	}
+	d.state["stale"] = count
+	mqttPublish(mqttTopic(d.WiFi.MAC, "state"), d.state, true)
+}
+
+// updateMiBeaconRejected publish count of MiBeacon adverts with stale encryption
+// counter since start
+func (d *GatewayDevice) updateMiBeaconRejected(count int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.state["mibeacon_rejected"] = count
+	mqttPublish(mqttTopic(d.WiFi.MAC, "state"), d.state, true)
+}
+
+// updateMQTT publish counts of MQTT reconnects since start, messages sent from
+// outbox after last reconnect and messages dropped from full outbox since start
+func (d *GatewayDevice) updateMQTT(reconnects, flushed, dropped int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.state["mqtt_reconnects"] = reconnects
+	d.state["mqtt_outbox"] = flushed
+	d.state["mqtt_dropped"] = dropped
+	mqttPublish(mqttTopic(d.WiFi.MAC, "state"), d.state, true)
 }
 
 func (d *GatewayDevice) updateAlarmState(state string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
 	if state != "triggered" {
 		if state == "" {
 			// restore state after triggered
@@ -64,18 +114,24 @@ func (d *GatewayDevice) updateAlarmState(state string) {
 		}
 	}
 	d.state["alarm_state"] = state
-	mqttPublish("gw3/"+d.WiFi.MAC+"/state", d.state, true)
+	mqttPublish(mqttTopic(d.WiFi.MAC, "state"), d.state, true)
 }
 
 func (d *GatewayDevice) updateEvent(data *dict.Dict) {
-	mqttPublish("gw3/"+d.WiFi.MAC+"/event", data, false)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	mqttPublish(mqttTopic(d.WiFi.MAC, "event"), data, false)
 }
 
 func (d *GatewayDevice) updateBT(fw string, addr uint16, ivi uint32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
 	d.BT.FwVersion = fw
 	d.BT.Addr = addr
 	d.BT.IVIndex = ivi
-	mqttPublish("gw3/"+d.WiFi.MAC+"/info", d, true)
+	mqttPublish(mqttTopic(d.WiFi.MAC, "info"), d, true)
 }
 
 func (d *GatewayDevice) getState() {
@@ -108,6 +164,26 @@ func (d *GatewayDevice) setState(p []byte) {
 		mainInitLogger(value)
 	}
 
+	switch value := (*payload)["raw"].(type) {
+	case bool:
+		// fast enable or disable raw mode with current filters
+		raw := &ConfigRaw{}
+		if current := config.GetRaw(); current != nil {
+			*raw = *current
+		}
+		raw.Enabled = value
+		config.SetRaw(raw)
+	case map[string]interface{}:
+		raw := &ConfigRaw{}
+		if b, err := json.Marshal(value); err == nil {
+			if err = json.Unmarshal(b, raw); err == nil {
+				config.SetRaw(raw)
+			} else {
+				log.Warn().Err(err).Send()
+			}
+		}
+	}
+
 	if value, ok := payload.TryGetString("test"); ok {
 		switch value {
 		case "error":
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/AlexxIT/gw3/gap"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// bleSnapshot - BLE device info, merged state, last seen time and last
+// MiBeacon encryption counter
+type bleSnapshot struct {
+	Info     *BLEDevice `json:"info"`
+	State    gap.Map    `json:"state,omitempty"`
+	LastSeen int64      `json:"last_seen,omitempty"`
+	Counter  uint32     `json:"mibeacon_counter,omitempty"`
+}
+
+// time of next snapshot write
+var bleSnapshotNext time.Time
+
+// bleSnapshotConfig returns snapshot path and write interval, 0 - disabled.
+// By default snapshot is stored in memory (tmp) to protect the NAND.
+func bleSnapshotConfig() (path string, interval time.Duration) {
+	path, interval = "/tmp/gw3_devices.json", time.Minute
+	if p := config.Persist; p != nil {
+		if p.Path != "" {
+			path = p.Path
+		}
+		interval = time.Duration(p.Interval) * time.Second
+	}
+	return
+}
+
+// bleRestoreDevices loads devices from snapshot, should be called before MQTT connection
+func bleRestoreDevices() {
+	path, interval := bleSnapshotConfig()
+	if interval == 0 {
+		return
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn().Err(err).Send()
+		}
+		return
+	}
+
+	var snapshots map[string]bleSnapshot
+	if err = json.Unmarshal(data, &snapshots); err != nil {
+		log.Warn().Err(err).Msg("Can't restore devices")
+		return
+	}
+
+	for mac, snapshot := range snapshots {
+		if snapshot.Info == nil {
+			continue
+		}
+		device := snapshot.Info
+		device.MAC = mac
+		device.state = snapshot.State
+		device.lastSeen = snapshot.LastSeen
+		devices[mac] = device
+
+		if snapshot.Counter > 0 {
+			btchipMiBeaconCounters[mac] = btchipMiBeaconCounter{counter: snapshot.Counter}
+		}
+	}
+
+	log.Info().Int("count", len(snapshots)).Msg("Restore devices")
+
+	bleSnapshotNext = time.Now().Add(interval)
+}
+
+// bleSaveDevices writes snapshot not more than once per interval,
+// should be called only from BT chip goroutine, because it changes devices state
+func bleSaveDevices() {
+	path, interval := bleSnapshotConfig()
+	if interval == 0 {
+		return
+	}
+
+	now := time.Now()
+	if now.Before(bleSnapshotNext) {
+		return
+	}
+	bleSnapshotNext = now.Add(interval)
+
+	snapshots := make(map[string]bleSnapshot)
+	for mac, device := range devices {
+		if d, ok := device.(*BLEDevice); ok {
+			snapshots[mac] = bleSnapshot{
+				Info:     d,
+				State:    d.state,
+				LastSeen: atomic.LoadInt64(&d.lastSeen),
+				Counter:  btchipMiBeaconCounters[mac].counter,
+			}
+		}
+	}
+
+	data, err := json.Marshal(snapshots)
+	if err != nil {
+		log.Error().Caller().Err(err).Send()
+		return
+	}
+
+	if err = writeFileAtomic(path, data); err != nil {
+		log.Error().Caller().Err(err).Send()
+	}
+}
@@ -0,0 +1,383 @@
+package gap
+
+import (
+	"crypto/aes"
+	"encoding/hex"
+	"fmt"
+	"github.com/AlexxIT/gw3/crypt"
+	"strings"
+)
+
+// bthomeObject describes BTHome object ID: state name, data size in bytes,
+// signed flag and value scale (1 - integer value without scale)
+type bthomeObject struct {
+	name   string
+	size   int
+	signed bool
+	scale  float32
+}
+
+// https://bthome.io/format/
+var bthomeObjects = map[byte]bthomeObject{
+	0x00: {"seq", 1, false, 1},
+	0x01: {"battery", 1, false, 1},
+	0x02: {"temperature", 2, true, 0.01},
+	0x03: {"humidity", 2, false, 0.01},
+	0x04: {"pressure", 3, false, 0.01},
+	0x05: {"illuminance", 3, false, 0.01},
+	0x06: {"weight", 2, false, 0.01},
+	0x07: {"weight_lb", 2, false, 0.01},
+	0x08: {"dewpoint", 2, true, 0.01},
+	0x09: {"count", 1, false, 1},
+	0x0A: {"energy", 3, false, 0.001},
+	0x0B: {"power", 3, false, 0.01},
+	0x0C: {"voltage", 2, false, 1}, // mV, same as ATC
+	0x0D: {"pm25", 2, false, 1},
+	0x0E: {"pm10", 2, false, 1},
+	0x0F: {"binary", 1, false, 1},
+	0x10: {"switch", 1, false, 1},
+	0x11: {"opening", 1, false, 1},
+	0x12: {"co2", 2, false, 1},
+	0x13: {"tvoc", 2, false, 1},
+	0x14: {"moisture", 2, false, 0.01},
+	0x15: {"battery_low", 1, false, 1},
+	0x16: {"battery_charging", 1, false, 1},
+	0x17: {"co", 1, false, 1},
+	0x18: {"cold", 1, false, 1},
+	0x19: {"connectivity", 1, false, 1},
+	0x1A: {"door", 1, false, 1},
+	0x1B: {"garage_door", 1, false, 1},
+	0x1C: {"gas", 1, false, 1},
+	0x1D: {"heat", 1, false, 1},
+	0x1E: {"light", 1, false, 1},
+	0x1F: {"lock", 1, false, 1},
+	0x20: {"water_leak", 1, false, 1},
+	0x21: {"motion", 1, false, 1},
+	0x22: {"moving", 1, false, 1},
+	0x23: {"occupancy", 1, false, 1},
+	0x24: {"plug", 1, false, 1},
+	0x25: {"presence", 1, false, 1},
+	0x26: {"problem", 1, false, 1},
+	0x27: {"running", 1, false, 1},
+	0x28: {"safety", 1, false, 1},
+	0x29: {"smoke", 1, false, 1},
+	0x2A: {"sound", 1, false, 1},
+	0x2B: {"tamper", 1, false, 1},
+	0x2C: {"vibration", 1, false, 1},
+	0x2D: {"window", 1, false, 1},
+	0x2E: {"humidity", 1, false, 1},
+	0x2F: {"moisture", 1, false, 1},
+	0x3D: {"count", 2, false, 1},
+	0x3E: {"count", 4, false, 1},
+	0x3F: {"rotation", 2, true, 0.1},
+	0x40: {"distance", 2, false, 1}, // mm
+	0x41: {"distance_m", 2, false, 0.1},
+	0x42: {"duration", 3, false, 0.001},
+	0x43: {"current", 2, false, 0.001},
+	0x44: {"speed", 2, false, 0.01},
+	0x45: {"temperature", 2, true, 0.1},
+	0x46: {"uv", 1, false, 0.1},
+	0x47: {"volume", 2, false, 0.1},
+	0x48: {"volume_ml", 2, false, 1},
+	0x49: {"volume_flow_rate", 2, false, 0.001},
+	0x4A: {"voltage", 2, false, 100}, // 0.1 V to mV
+	0x4B: {"gas_volume", 3, false, 0.001},
+	0x4C: {"gas_volume", 4, false, 0.001},
+	0x4D: {"energy", 4, false, 0.001},
+	0x4E: {"volume", 4, false, 0.001},
+	0x4F: {"water", 4, false, 0.001},
+	0x50: {"timestamp", 4, false, 1},
+	0x51: {"acceleration", 2, false, 0.001},
+	0x52: {"gyroscope", 2, false, 0.001},
+	0x55: {"volume_storage", 4, false, 0.001},
+	0x56: {"conductivity", 2, false, 1},
+	0x57: {"temperature", 1, true, 1},
+	0x58: {"temperature", 1, true, 0.35},
+	0x59: {"count", 1, true, 1},
+	0x5A: {"count", 2, true, 1},
+	0x5B: {"count", 4, true, 1},
+	0x5C: {"power", 4, true, 0.01},
+	0x5D: {"current", 2, true, 0.001},
+	0x5E: {"direction", 2, false, 0.01},
+	0x5F: {"precipitation", 2, false, 0.1},
+	0x60: {"channel", 1, false, 1},
+	0x61: {"rotational_speed", 2, false, 1},
+	0xF0: {"device_type", 2, false, 1},
+	0xF1: {"fw_version", 4, false, 1},
+	0xF2: {"fw_version", 3, false, 1},
+}
+
+// ParseBTHome decodes BTHome v1 (UUID 0x181C and encrypted 0x181E) and
+// BTHome v2 (UUID 0xFCD2) service data without UUID bytes.
+// Button and dimmer events are returned separately from the state.
+// Returns useful as ParseMiBeacon: 0 - skip, 1 - encrypted, 2 - decoded.
+// https://bthome.io/
+func ParseBTHome(uuid uint16, mac string, b []byte, getBindkey func(string) string) (state, event Map, useful byte) {
+	switch uuid {
+	case 0x181C:
+		return bthomeDecodeV1(b), nil, 2
+
+	case 0x181E:
+		key := getBindkey(mac)
+		if key == "" {
+			return nil, nil, 1
+		}
+		plain := bthomeDecrypt(b, mac, []byte{0x1E, 0x18}, key, []byte{0x11})
+		if plain == nil {
+			return nil, nil, 1
+		}
+		return bthomeDecodeV1(plain), nil, 2
+
+	case 0xFCD2:
+		if len(b) < 2 {
+			return nil, nil, 0
+		}
+
+		info := b[0]
+		// version in bits 5-7
+		if info>>5 != 2 {
+			return nil, nil, 0
+		}
+
+		b = b[1:]
+
+		// MAC included in payload (reversed)
+		if info&0b10 > 0 {
+			if len(b) < 6 {
+				return nil, nil, 0
+			}
+			b = b[6:]
+		}
+
+		// encryption flag
+		if info&0b1 > 0 {
+			key := getBindkey(mac)
+			if key == "" {
+				return nil, nil, 1
+			}
+			if b = bthomeDecrypt(b, mac, []byte{0xD2, 0xFC, info}, key, nil); b == nil {
+				return nil, nil, 1
+			}
+		}
+
+		state, event = bthomeDecodeV2(b)
+		return state, event, 2
+	}
+
+	return nil, nil, 0
+}
+
+// bthomeDecrypt payload: ciphertext + counter (4 bytes) + MIC (4 bytes)
+func bthomeDecrypt(b []byte, mac string, uuid []byte, key string, adata []byte) []byte {
+	if len(b) < 9 {
+		return nil
+	}
+
+	key2, err := hex.DecodeString(key)
+	if err != nil {
+		return nil
+	}
+	c, err := aes.NewCipher(key2)
+	if err != nil {
+		return nil
+	}
+
+	mac2, err := hex.DecodeString(strings.ReplaceAll(mac, ":", ""))
+	if err != nil {
+		return nil
+	}
+
+	// mac + uuid (+ device info for v2) + counter
+	nonce := make([]byte, 0, 13)
+	nonce = append(nonce, mac2...)
+	nonce = append(nonce, uuid...)
+	nonce = append(nonce, b[len(b)-8:len(b)-4]...)
+
+	ccm, err := crypt.NewCCMWithNonceAndTagSizes(c, len(nonce), 4)
+	if err != nil {
+		return nil
+	}
+
+	ciphertext := make([]byte, 0, len(b)-4)
+	ciphertext = append(ciphertext, b[:len(b)-8]...)
+	ciphertext = append(ciphertext, b[len(b)-4:]...)
+
+	plain, err := ccm.Open(nil, nonce, ciphertext, adata)
+	if err != nil {
+		return nil
+	}
+
+	return plain
+}
+
+func bthomeDecodeV1(b []byte) Map {
+	result := Map{}
+
+	var i int
+	for i < len(b) {
+		// 3 bits | format: 0 - uint, 1 - int, 2 - float, 3 - string, 4 - mac
+		// 5 bits | length with object ID byte
+		format := b[i] >> 5
+		l := int(b[i] & 0b11111)
+		if l < 1 || i+1+l > len(b) {
+			break
+		}
+
+		id := b[i+1]
+		data := b[i+2 : i+1+l]
+
+		if obj, ok := bthomeObjects[id]; ok && format < 2 {
+			obj.size = len(data)
+			obj.signed = format == 1
+			bthomeSetValue(result, obj, data)
+		}
+
+		i += 1 + l
+	}
+
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+func bthomeDecodeV2(b []byte) (Map, Map) {
+	result := Map{}
+	event := Map{}
+
+	var i, button int
+loop:
+	for i < len(b) {
+		id := b[i]
+		i++
+
+		switch id {
+		case 0x3A: // button
+			if i+1 > len(b) {
+				break loop
+			}
+			// buttons are numbered by position, event 0x00 - not pressed
+			button++
+			if action := bthomeButtonAction(b[i]); action != "" {
+				if button == 1 {
+					event["action"] = action
+				} else {
+					event[fmt.Sprintf("action_%d", button)] = action
+				}
+			}
+			i++
+			continue
+
+		case 0x3C: // dimmer
+			if i+2 > len(b) {
+				break loop
+			}
+			// direction and unsigned number of steps
+			steps := int16(b[i+1])
+			switch b[i] {
+			case 1: // rotate left
+				event["action"] = "rotate"
+				event["angle"] = -steps
+			case 2: // rotate right
+				event["action"] = "rotate"
+				event["angle"] = steps
+			}
+			i += 2
+			continue
+
+		case 0x53, 0x54: // text and raw, first byte is length
+			if i+1 > len(b) || i+1+int(b[i]) > len(b) {
+				break loop
+			}
+			data := b[i+1 : i+1+int(b[i])]
+			if id == 0x53 {
+				bthomeSetKey(result, "text", string(data))
+			} else {
+				bthomeSetKey(result, "raw", hex.EncodeToString(data))
+			}
+			i += 1 + len(data)
+			continue
+		}
+
+		obj, ok := bthomeObjects[id]
+		if !ok || i+obj.size > len(b) {
+			// unknown object ID, we can't know it size
+			break loop
+		}
+
+		bthomeSetValue(result, obj, b[i:i+obj.size])
+
+		i += obj.size
+	}
+
+	if len(result) == 0 {
+		result = nil
+	}
+	if len(event) == 0 {
+		event = nil
+	}
+	return result, event
+}
+
+func bthomeSetValue(result Map, obj bthomeObject, data []byte) {
+	if len(data) == 0 || len(data) > 4 {
+		return
+	}
+
+	var value uint32
+	for i, v := range data {
+		value |= uint32(v) << (8 * i)
+	}
+
+	var signed int32
+	if obj.signed {
+		// sign extend value from data size
+		shift := 32 - 8*len(data)
+		signed = int32(value<<shift) >> shift
+	}
+
+	switch {
+	case obj.scale != 1 && obj.signed:
+		bthomeSetKey(result, obj.name, float32(signed)*obj.scale)
+	case obj.scale != 1:
+		bthomeSetKey(result, obj.name, float32(value)*obj.scale)
+	case obj.signed:
+		bthomeSetKey(result, obj.name, signed)
+	default:
+		bthomeSetKey(result, obj.name, value)
+	}
+}
+
+// bthomeSetKey adds suffix for repeated objects, ex. multi-button devices
+func bthomeSetKey(result Map, key string, value interface{}) {
+	if _, ok := result[key]; ok {
+		for i := 2; ; i++ {
+			name := fmt.Sprintf("%s_%d", key, i)
+			if _, ok = result[name]; !ok {
+				key = name
+				break
+			}
+		}
+	}
+	result[key] = value
+}
+
+func bthomeButtonAction(event byte) string {
+	switch event {
+	case 0x01:
+		return "single"
+	case 0x02:
+		return "double"
+	case 0x03:
+		return "triple"
+	case 0x04:
+		return "long"
+	case 0x05:
+		return "long_double"
+	case 0x06:
+		return "long_triple"
+	case 0x80:
+		return "hold"
+	}
+	return ""
+}
@@ -0,0 +1,101 @@
+package gap
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// Eddystone service data (UUID 0xFEAA), data without len, 0x16 and UUID
+// https://github.com/google/eddystone/blob/master/protocol-specification.md
+
+// ParseEddystoneUID decodes UID frame
+func ParseEddystoneUID(b []byte) Map {
+	// 0       0x00
+	// 1       tx power at 0m
+	// 2..11   namespace
+	// 12..17  instance
+	// 18 19   reserved (can be omitted)
+	if len(b) < 18 || b[0] != 0x00 {
+		return nil
+	}
+
+	return Map{
+		"namespace": hex.EncodeToString(b[2:12]),
+		"instance":  hex.EncodeToString(b[12:18]),
+		"tx":        int8(b[1]),
+	}
+}
+
+// ParseEddystoneURL decodes URL frame
+func ParseEddystoneURL(b []byte) Map {
+	// 0       0x10
+	// 1       tx power at 0m
+	// 2       url scheme prefix
+	// 3..     encoded url
+	if len(b) < 4 || b[0] != 0x10 || int(b[2]) >= len(eddystoneSchemes) {
+		return nil
+	}
+
+	url := eddystoneSchemes[b[2]]
+	for _, c := range b[3:] {
+		if int(c) < len(eddystoneExpansions) {
+			url += eddystoneExpansions[c]
+		} else {
+			url += string(c)
+		}
+	}
+
+	return Map{
+		"url": url,
+		"tx":  int8(b[1]),
+	}
+}
+
+// ParseEddystoneTLM decodes unencrypted TLM frame
+func ParseEddystoneTLM(b []byte) Map {
+	// 0       0x20
+	// 1       version, 0x00 - unencrypted
+	// 2 3     battery voltage, mV (0 - not supported)
+	// 4 5     temperature, signed 8.8 fixed point (0x8000 - not supported)
+	// 6..9    advertising PDU count
+	// 10..13  time since power-on, 0.1 second
+	if len(b) != 14 || b[0] != 0x20 || b[1] != 0x00 {
+		return nil
+	}
+
+	result := Map{
+		"adv_count": binary.BigEndian.Uint32(b[6:]),
+		"uptime":    binary.BigEndian.Uint32(b[10:]) / 10,
+	}
+
+	if v := binary.BigEndian.Uint16(b[2:]); v != 0 {
+		result["voltage"] = v
+	}
+	if v := binary.BigEndian.Uint16(b[4:]); v != 0x8000 {
+		result["temperature"] = float32(int16(v)) / 256
+	}
+
+	return result
+}
+
+// ParseEddystoneEID decodes EID frame
+func ParseEddystoneEID(b []byte) Map {
+	// 0       0x30
+	// 1       tx power at 0m
+	// 2..9    ephemeral identifier
+	if len(b) != 10 || b[0] != 0x30 {
+		return nil
+	}
+
+	return Map{
+		"eid": hex.EncodeToString(b[2:10]),
+		"tx":  int8(b[1]),
+	}
+}
+
+var eddystoneSchemes = []string{"http://www.", "https://www.", "http://", "https://"}
+
+var eddystoneExpansions = []string{
+	".com/", ".org/", ".edu/", ".net/", ".info/", ".biz/", ".gov/",
+	".com", ".org", ".edu", ".net", ".info", ".biz", ".gov",
+}
@@ -0,0 +1,22 @@
+package gap
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseEddystoneEID(t *testing.T) {
+	b, _ := hex.DecodeString("30ec0123456789abcdef")
+	got := ParseEddystoneEID(b)
+	if got["eid"] != "0123456789abcdef" || got["tx"] != int8(-20) {
+		t.Errorf("got %v", got)
+	}
+
+	// UID frame and short EID frame
+	for _, s := range []string{"00ec0123456789abcdef", "30ec0123456789abcd"} {
+		b, _ = hex.DecodeString(s)
+		if got = ParseEddystoneEID(b); got != nil {
+			t.Errorf("%s: got %v, want nil", s, got)
+		}
+	}
+}
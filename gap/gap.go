@@ -45,6 +45,7 @@ var Brands = map[uint16]string{
 	0x0075: "Samsung",
 	0x00E0: "Google",
 	0x0157: "Huami",
+	0x0499: "Ruuvi",
 	0x05A7: "Sonos",
 }
 
@@ -0,0 +1,95 @@
+package gap
+
+import (
+	"encoding/binary"
+)
+
+// Govee devices use manufacturer specific data, data without len, 0xFF and company ID
+// https://github.com/custom-components/ble_monitor/blob/master/custom_components/ble_monitor/ble_parser/govee.py
+
+// ParseGoveeH5075 for H5072, H5075 (company ID 0xEC88)
+func ParseGoveeH5075(b []byte) Map {
+	// 0     0x00
+	// 1..3  temperature and humidity packed in big endian
+	// 4     battery
+	// 5     0x00
+	if len(b) != 6 || b[0] != 0x00 || b[5] != 0x00 {
+		return nil
+	}
+
+	temperature, humidity := goveeDecodePacked(b[1:4])
+	return Map{
+		"temperature": temperature,
+		"humidity":    humidity,
+		"battery":     b[4],
+	}
+}
+
+// ParseGoveeH5074 for H5051, H5074 (company ID 0xEC88)
+func ParseGoveeH5074(b []byte) Map {
+	// 0     0x00
+	// 1 2   temperature int16 little endian
+	// 3 4   humidity uint16 little endian
+	// 5     battery
+	// 6     0x02
+	if len(b) != 7 || b[0] != 0x00 || b[6] != 0x02 {
+		return nil
+	}
+
+	return Map{
+		"temperature": float32(int16(binary.LittleEndian.Uint16(b[1:]))) / 100,
+		"humidity":    float32(binary.LittleEndian.Uint16(b[3:])) / 100,
+		"battery":     b[5],
+	}
+}
+
+// ParseGoveeH5101 for H5101, H5102, H5177 (company ID 0x0001)
+func ParseGoveeH5101(b []byte) Map {
+	// 0 1   0x01 0x01
+	// 2..4  temperature and humidity packed in big endian
+	// 5     battery
+	// company ID 0x0001 is used by many devices, so check the prefix
+	if len(b) != 6 || b[0] != 0x01 || b[1] != 0x01 {
+		return nil
+	}
+
+	temperature, humidity := goveeDecodePacked(b[2:5])
+	return Map{
+		"temperature": temperature,
+		"humidity":    humidity,
+		"battery":     b[5],
+	}
+}
+
+// ParseGoveeH5179 for H5179 (company ID 0x8801)
+func ParseGoveeH5179(b []byte) Map {
+	// 0..3  unknown
+	// 4 5   temperature int16 little endian
+	// 6 7   humidity uint16 little endian
+	// 8     battery
+	if len(b) != 9 {
+		return nil
+	}
+
+	return Map{
+		"temperature": float32(int16(binary.LittleEndian.Uint16(b[4:]))) / 100,
+		"humidity":    float32(binary.LittleEndian.Uint16(b[6:])) / 100,
+		"battery":     b[8],
+	}
+}
+
+// goveeDecodePacked decodes 3 bytes value = temperature * 10000 + humidity * 10
+// highest bit is the sign of temperature
+func goveeDecodePacked(b []byte) (temperature float32, humidity float32) {
+	value := uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+
+	negative := value&0x800000 > 0
+	value &= 0x7FFFFF
+
+	temperature = float32(value/1000) / 10
+	if negative {
+		temperature = -temperature
+	}
+	humidity = float32(value%1000) / 10
+	return
+}
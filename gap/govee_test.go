@@ -0,0 +1,38 @@
+package gap
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseGovee(t *testing.T) {
+	tests := []struct {
+		name  string
+		parse func([]byte) Map
+		data  string
+		want  Map
+	}{
+		{"H5075", ParseGoveeH5075, "0003a7615a00", Map{"temperature": float32(23.9), "humidity": float32(45.7), "battery": byte(90)}},
+		{"H5075 negative", ParseGoveeH5075, "008190004b00", Map{"temperature": float32(-10.2), "humidity": float32(40.0), "battery": byte(75)}},
+		{"H5075 wrong prefix", ParseGoveeH5075, "0103a7615a00", nil},
+		{"H5075 wrong suffix", ParseGoveeH5075, "0003a7615a01", nil},
+		{"H5074", ParseGoveeH5074, "005609c4145a02", Map{"temperature": float32(23.9), "humidity": float32(53.16), "battery": byte(90)}},
+		{"H5074 wrong suffix", ParseGoveeH5074, "005609c4145a00", nil},
+		{"H5101", ParseGoveeH5101, "010103a76164", Map{"temperature": float32(23.9), "humidity": float32(45.7), "battery": byte(100)}},
+		{"H5101 foreign 0x0001 payload", ParseGoveeH5101, "0203a7616400", nil},
+		{"H5101 wrong length", ParseGoveeH5101, "010103a761", nil},
+	}
+	for _, test := range tests {
+		b, _ := hex.DecodeString(test.data)
+		got := test.parse(b)
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for k, v := range test.want {
+			if got[k] != v {
+				t.Errorf("%s: %s = %v, want %v", test.name, k, got[k], v)
+			}
+		}
+	}
+}
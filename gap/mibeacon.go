@@ -9,28 +9,66 @@ import (
 )
 
 type MiBeacon struct {
-	Mac     string   `json:"mac"`
-	Pdid    uint16   `json:"pdid"`
-	Eid     uint16   `json:"eid,omitempty"`
-	Edata   hexbytes `json:"edata,omitempty"`
-	Seq     byte     `json:"seq"`
-	Comment string   `json:"comment,omitempty"`
+	Mac     string           `json:"mac"`
+	Pdid    uint16           `json:"pdid"`
+	Objects []MiBeaconObject `json:"objects,omitempty"`
+	Seq     byte             `json:"seq"`
+	Comment string           `json:"comment,omitempty"`
+
+	// Encrypted payload has 4 bytes counter: 3 bytes ext counter + 1 byte seq
+	Encrypted bool   `json:"encrypted,omitempty"`
+	Counter   uint32 `json:"counter,omitempty"`
 }
 
-func (b *MiBeacon) Decode() Map {
-	switch b.Eid {
+type MiBeaconObject struct {
+	Eid   uint16   `json:"eid"`
+	Edata hexbytes `json:"edata"`
+}
+
+// Decode all objects and merge them in two Maps: state values and events,
+// because one frame can have both of them
+func (b *MiBeacon) Decode() (state, event Map) {
+	for _, obj := range b.Objects {
+		if len(obj.Edata) == 0 {
+			continue
+		}
+		data := b.decodeObject(obj)
+		if data == nil {
+			continue
+		}
+		if data.IsEvent() {
+			event = mibeaconMerge(event, data)
+		} else {
+			state = mibeaconMerge(state, data)
+		}
+	}
+	return
+}
+
+func mibeaconMerge(result, data Map) Map {
+	if result == nil {
+		return data
+	}
+	for k, v := range data {
+		result[k] = v
+	}
+	return result
+}
+
+func (b *MiBeacon) decodeObject(obj MiBeaconObject) Map {
+	switch obj.Eid {
 	case 0x1001: // 4097
-		if len(b.Edata) != 3 {
+		if len(obj.Edata) != 3 {
 			return nil
 		}
 		var action string
 		switch b.Pdid {
 		case 950: // Yeelight Dimmer
-			switch b.Edata[2] {
+			switch obj.Edata[2] {
 			case 3:
-				switch b.Edata[0] {
+				switch obj.Edata[0] {
 				case 0:
-					switch b.Edata[1] {
+					switch obj.Edata[1] {
 					case 1:
 						action = "single"
 					case 2:
@@ -43,28 +81,28 @@ func (b *MiBeacon) Decode() Map {
 						action = "quintuple"
 					}
 				case 1:
-					return Map{"action": "hold", "duration": b.Edata[1]}
+					return Map{"action": "hold", "duration": obj.Edata[1]}
 				}
 			case 4:
-				if b.Edata[0] == 0 {
+				if obj.Edata[0] == 0 {
 					// rotate with sign (right or left)
-					angle := int8(b.Edata[1])
+					angle := int8(obj.Edata[1])
 					return Map{"action": "rotate", "angle": angle}
-				} else if b.Edata[1] == 0 {
+				} else if obj.Edata[1] == 0 {
 					// hold and rotate with sign (right or left)
-					angle := int8(b.Edata[0])
+					angle := int8(obj.Edata[0])
 					return Map{"action": "rotate_hold", "angle": angle}
 				}
 			}
 		case 1249: // Xiaomi Magic Cube
-			switch b.Edata[0] {
+			switch obj.Edata[0] {
 			case 0:
 				action = "right"
 			case 1:
 				action = "left"
 			}
 		case 1983: // Yeelight Button S1
-			switch b.Edata[2] {
+			switch obj.Edata[2] {
 			case 0:
 				action = "single"
 			case 1:
@@ -73,12 +111,12 @@ func (b *MiBeacon) Decode() Map {
 				action = "hold"
 			}
 		default:
-			if b.Edata[0] == 0 {
+			if obj.Edata[0] == 0 {
 				// Xiaomi Motion Sensor 2, Xiaomi Water Leak Sensor
 				action = "single"
 			} else {
 				// all unknown devices
-				action = fmt.Sprintf("%x", b.Edata)
+				action = fmt.Sprintf("%x", obj.Edata)
 			}
 		}
 		if action != "" {
@@ -86,22 +124,22 @@ func (b *MiBeacon) Decode() Map {
 		}
 	case 0x1002: // 4098
 		// No sleep (0x00), falling asleep (0x01)
-		return Map{"sleep": b.Edata[0]}
+		return Map{"sleep": obj.Edata[0]}
 	case 0x1003: // 4099
-		return Map{"rssi": int8(b.Edata[0])}
+		return Map{"rssi": int8(obj.Edata[0])}
 	case 0x1004: // 4100
-		if len(b.Edata) == 2 {
-			value := float32(int16(binary.LittleEndian.Uint16(b.Edata))) / 10
+		if len(obj.Edata) == 2 {
+			value := float32(int16(binary.LittleEndian.Uint16(obj.Edata))) / 10
 			return Map{"temperature": value}
 		}
 	case 0x1005: // 4101
-		if len(b.Edata) == 2 {
+		if len(obj.Edata) == 2 {
 			// Kettle, thanks https://github.com/custom-components/ble_monitor/
-			return Map{"power": b.Edata[0], "temperature": float32(b.Edata[1])}
+			return Map{"power": obj.Edata[0], "temperature": float32(obj.Edata[1])}
 		}
 	case 0x1006: // 4102
-		if len(b.Edata) == 2 {
-			value := float32(binary.LittleEndian.Uint16(b.Edata)) / 10
+		if len(obj.Edata) == 2 {
+			value := float32(binary.LittleEndian.Uint16(obj.Edata)) / 10
 			if b.Pdid == 903 || b.Pdid == 1371 {
 				// two models has bug, they increase humidity on each data by 0.1
 				value = float32(int32(value))
@@ -109,8 +147,8 @@ func (b *MiBeacon) Decode() Map {
 			return Map{"humidity": value}
 		}
 	case 0x1007: // 4103
-		if len(b.Edata) == 3 {
-			value := uint32(b.Edata[0]) | uint32(b.Edata[1])<<8 | uint32(b.Edata[2])<<16
+		if len(obj.Edata) == 3 {
+			value := uint32(obj.Edata[0]) | uint32(obj.Edata[1])<<8 | uint32(obj.Edata[2])<<16
 			if b.Pdid == 2038 {
 				// Night Light 2: 1 - no light, 100 - light
 				if value >= 100 {
@@ -124,78 +162,78 @@ func (b *MiBeacon) Decode() Map {
 		}
 	case 0x1008: // 4104
 		// Humidity percentage, range: 0-100
-		return Map{"moisture": b.Edata[0]}
+		return Map{"moisture": obj.Edata[0]}
 	case 0x1009: // 4105
-		if len(b.Edata) == 2 {
+		if len(obj.Edata) == 2 {
 			// Soil EC value, Unit us/cm, range: 0-5000
-			value := binary.LittleEndian.Uint16(b.Edata)
+			value := binary.LittleEndian.Uint16(obj.Edata)
 			return Map{"conductivity": value}
 		}
 	case 0x100A: // 4106
-		return Map{"battery": b.Edata[0]}
+		return Map{"battery": obj.Edata[0]}
 	case 0x100D: // 4109
-		if len(b.Edata) == 4 {
-			value1 := float32(int16(binary.LittleEndian.Uint16(b.Edata))) / 10
-			value2 := float32(binary.LittleEndian.Uint16(b.Edata[2:])) / 10
+		if len(obj.Edata) == 4 {
+			value1 := float32(int16(binary.LittleEndian.Uint16(obj.Edata))) / 10
+			value2 := float32(binary.LittleEndian.Uint16(obj.Edata[2:])) / 10
 			return Map{"temperature": value1, "humidity": value2}
 		}
 	case 0x100E: // 4110
 		// 1 => true => on => unlocked
-		if b.Edata[0] == 0 {
+		if obj.Edata[0] == 0 {
 			return Map{"lock": 1}
 		} else {
 			return Map{"lock": 0}
 		}
 	case 0x100F: // 4111
 		// 1 => true => on => dooor opening
-		if b.Edata[0] == 0 {
+		if obj.Edata[0] == 0 {
 			return Map{"opening": 1}
 		} else {
 			return Map{"opening": 0}
 		}
 	case 0x1010: // 4112
-		if len(b.Edata) == 2 {
-			value := float32(int16(binary.LittleEndian.Uint16(b.Edata))) / 100
+		if len(obj.Edata) == 2 {
+			value := float32(int16(binary.LittleEndian.Uint16(obj.Edata))) / 100
 			return Map{"formaldehyde": value}
 		}
 	case 0x1012: // 4114
 		// 1 => true => open
-		return Map{"opening": b.Edata[0]}
+		return Map{"opening": obj.Edata[0]}
 	case 0x1013: // 4115
 		// Remaining percentage, range 0~100
-		return Map{"supply": b.Edata[0]}
+		return Map{"supply": obj.Edata[0]}
 	case 0x1014: // 4116
 		// 1 => on => wet
-		return Map{"water_leak": b.Edata[0]}
+		return Map{"water_leak": obj.Edata[0]}
 	case 0x1015: // 4117
 		// 1 => on => alarm
-		return Map{"smoke": b.Edata[0]}
+		return Map{"smoke": obj.Edata[0]}
 	case 0x1016: // 4118
 		// 1 => on => alarm
-		return Map{"gas": b.Edata[0]}
+		return Map{"gas": obj.Edata[0]}
 	case 0x1017: // 4119
-		if len(b.Edata) == 4 {
+		if len(obj.Edata) == 4 {
 			// The duration of the unmanned state, in seconds
-			value := binary.LittleEndian.Uint32(b.Edata)
+			value := binary.LittleEndian.Uint32(obj.Edata)
 			return Map{"idle_time": value}
 		}
 	case 0x1018: // 4120
 		// Door Sensor 2: 0 - dark, 1 - light
-		return Map{"light": b.Edata[0]}
+		return Map{"light": obj.Edata[0]}
 	case 0x1019: // 4121
 		// 0x00: open the door, 0x01: close the door,
 		// 0x02: not closed after timeout, 0x03: device reset
 		// 1 => true => open
-		switch b.Edata[0] {
+		switch obj.Edata[0] {
 		case 0:
 			return Map{"contact": 1}
 		case 1:
 			return Map{"contact": 0}
 		}
 	case 0x06:
-		if len(b.Edata) == 5 {
-			actionID := b.Edata[4]
-			keyID := binary.LittleEndian.Uint32(b.Edata)
+		if len(obj.Edata) == 5 {
+			actionID := obj.Edata[4]
+			keyID := binary.LittleEndian.Uint32(obj.Edata)
 			return Map{
 				"action":    "fingerprint",
 				"action_id": actionID,
@@ -204,30 +242,30 @@ func (b *MiBeacon) Decode() Map {
 			}
 		}
 	case 0x07:
-		actionID := b.Edata[0]
+		actionID := obj.Edata[0]
 		return Map{
 			"action":    "door",
 			"action_id": actionID,
 			"message":   mibeaconDoorAction(actionID),
 		}
 	case 0x0008:
-		if b.Edata[0] > 0 {
+		if obj.Edata[0] > 0 {
 			return Map{"action": "armed", "state": true}
 		} else {
 			return Map{"action": "armed", "state": false}
 		}
 	case 0x0B: // 11
 		var keyID string
-		actionID := b.Edata[0] & 0xF
-		methodID := b.Edata[0] >> 4
-		key := binary.LittleEndian.Uint32(b.Edata[1:])
+		actionID := obj.Edata[0] & 0xF
+		methodID := obj.Edata[0] >> 4
+		key := binary.LittleEndian.Uint32(obj.Edata[1:])
 		err := mibeaconLockError(key)
 		if err == "" && methodID > 0 {
 			keyID = fmt.Sprintf("%d", key&0xFFFF)
 		} else {
 			keyID = fmt.Sprintf("%04x", key)
 		}
-		timestamp := binary.LittleEndian.Uint32(b.Edata[5:])
+		timestamp := binary.LittleEndian.Uint32(obj.Edata[5:])
 		return Map{
 			"action":    "lock",
 			"action_id": actionID,
@@ -239,11 +277,11 @@ func (b *MiBeacon) Decode() Map {
 			"timestamp": timestamp,
 		}
 	case 0x0F: // 15
-		if len(b.Edata) == 3 {
+		if len(obj.Edata) == 3 {
 			// Night Light 2: 1 - moving no light, 100 - moving with light
 			// Motion Sensor 2: 0 - moving no light, 256 - moving with light
 			// Qingping Motion Sensor - moving with illuminance data
-			value := uint32(b.Edata[0]) | uint32(b.Edata[1])<<8 | uint32(b.Edata[2])<<16
+			value := uint32(obj.Edata[0]) | uint32(obj.Edata[1])<<8 | uint32(obj.Edata[2])<<16
 			if b.Pdid == 2691 {
 				return Map{"action": "motion", "motion": 1, "illuminance": value}
 			} else if value >= 100 {
@@ -253,14 +291,19 @@ func (b *MiBeacon) Decode() Map {
 			}
 		}
 	case 0x10:
-		if len(b.Edata) == 2 {
+		if len(obj.Edata) == 2 {
 			// Toothbrush Т500
-			if b.Edata[0] == 0 {
-				return Map{"action": "start", "counter": b.Edata[1]}
+			if obj.Edata[0] == 0 {
+				return Map{"action": "start", "counter": obj.Edata[1]}
 			} else {
-				return Map{"action": "finish", "score": b.Edata[1]}
+				return Map{"action": "finish", "score": obj.Edata[1]}
 			}
 		}
+	default:
+		if obj.Eid >= 0x4800 {
+			// MIoT-spec object IDs
+			return miotDecodeObject(obj)
+		}
 	}
 	return nil
 }
@@ -310,16 +353,21 @@ func ParseMiBeacon(data []byte, getBindkey func(string) string) (mibeacon *MiBea
 		// keys can be nil, no problem
 		key := getBindkey(mibeacon.Mac)
 		if key != "" {
+			var ext []byte
 			switch version {
 			case 2, 3:
 				payload = mibeaconDecode1(data, i, key)
+				ext = data[len(data)-4 : len(data)-1]
 			case 4, 5:
 				payload = mibeaconDecode4(data, i, key)
+				ext = data[len(data)-7 : len(data)-4]
 			}
 			if payload == nil {
 				mibeacon.Comment = "wrong enc key"
 				return mibeacon, 1
 			}
+			mibeacon.Encrypted = true
+			mibeacon.Counter = uint32(mibeacon.Seq) | uint32(ext[0])<<8 | uint32(ext[1])<<16 | uint32(ext[2])<<24
 		} else {
 			mibeacon.Comment = "encrypted"
 			return mibeacon, 1
@@ -331,20 +379,28 @@ func ParseMiBeacon(data []byte, getBindkey func(string) string) (mibeacon *MiBea
 	}
 
 	if len(payload) < 4 {
-		mibeacon.Edata = payload
 		mibeacon.Comment = "small payload"
 		return mibeacon, 0
 	}
 
-	// skip payload len check because ATC_MiThermometer has wrong payload
-	//if payload[2] != byte(len(payload))-3 {
-	//	mibeacon.Edata = hex.EncodeToString(payload])
-	//	mibeacon.Comment = "wrong len payload"
-	//	return mibeacon, 1
-	//}
-
-	mibeacon.Eid = binary.LittleEndian.Uint16(payload)
-	mibeacon.Edata = payload[3:]
+	// 2 byte | object ID
+	// 1 byte | object len
+	// X byte | object data
+	for i := 0; i+3 < len(payload); {
+		obj := MiBeaconObject{Eid: binary.LittleEndian.Uint16(payload[i:])}
+		l := int(payload[i+2])
+		if i+3+l > len(payload) {
+			if i == 0 {
+				// ATC_MiThermometer has wrong payload len, use all data for single object
+				obj.Edata = payload[3:]
+				mibeacon.Objects = append(mibeacon.Objects, obj)
+			}
+			break
+		}
+		obj.Edata = payload[i+3 : i+3+l]
+		mibeacon.Objects = append(mibeacon.Objects, obj)
+		i += 3 + l
+	}
 
 	return mibeacon, 2
 }
@@ -368,7 +424,7 @@ func mibeaconDecode1(mibeacon []byte, pos int, key string) []byte {
 	// mac5
 	nonce = append(nonce, mibeacon[5:10]...)
 
-	// witout tag validating, because tag only 1 byte len
+	// decrypt without tag, because old versions have only first byte of it
 	ccm, err := crypt.NewCCMWithNonceAndTagSizes(c, len(nonce), 0)
 	if err != nil {
 		return nil
@@ -381,6 +437,25 @@ func mibeaconDecode1(mibeacon []byte, pos int, key string) []byte {
 		return nil
 	}
 
+	// MIC is the first byte of 16 bytes tag, CCM tag depends on its size,
+	// so it differs from the first byte of 4 bytes tag (checked by real frame in tests)
+	ccm, err = crypt.NewCCMWithNonceAndTagSizes(c, len(nonce), 16)
+	if err != nil {
+		return nil
+	}
+	if sealed := ccm.Seal(nil, nonce, plain, []byte{0x11}); sealed[len(plain)] != mibeacon[len(mibeacon)-1] {
+		return nil
+	}
+
+	// objects len should cover all payload
+	i := 0
+	for i+3 <= len(plain) {
+		i += 3 + int(plain[i+2])
+	}
+	if i != len(plain) {
+		return nil
+	}
+
 	return plain
 }
 
@@ -399,6 +474,7 @@ func mibeaconDecode4(mibeacon []byte, pos int, key string) []byte {
 	// counter
 	nonce = append(nonce, mibeacon[len(mibeacon)-7:len(mibeacon)-4]...)
 
+	// full MIC validation, 4 bytes tag
 	ccm, err := crypt.NewCCMWithNonceAndTagSizes(c, len(nonce), 4)
 	if err != nil {
 		return nil
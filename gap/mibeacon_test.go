@@ -0,0 +1,35 @@
+package gap
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// legacy (v3) encrypted frame of Yeelight Dimmer YLKG07YL with known bindkey,
+// the last byte is the first byte of 16 bytes CCM tag
+const (
+	mibeaconLegacyFrame = "5830b603d28b98c54124f8c3491476757e00000099"
+	mibeaconLegacyKey   = "b853075158487ca39a5b5ea9"
+)
+
+func TestParseMiBeaconLegacyEncrypted(t *testing.T) {
+	getBindkey := func(string) string { return mibeaconLegacyKey }
+
+	b, _ := hex.DecodeString(mibeaconLegacyFrame)
+	mibeacon, useful := ParseMiBeacon(b, getBindkey)
+	if useful != 2 || !mibeacon.Encrypted || len(mibeacon.Objects) != 1 {
+		t.Fatalf("useful = %d, mibeacon = %+v", useful, mibeacon)
+	}
+	if obj := mibeacon.Objects[0]; obj.Eid != 0x1001 || hex.EncodeToString(obj.Edata) != "000103" {
+		t.Errorf("object = %+v", obj)
+	}
+	if mibeacon.Counter != 0xD2 {
+		t.Errorf("counter = %d", mibeacon.Counter)
+	}
+
+	// wrong MIC
+	b[len(b)-1] ^= 1
+	if _, useful = ParseMiBeacon(b, getBindkey); useful != 1 {
+		t.Errorf("wrong MIC: useful = %d, want 1", useful)
+	}
+}
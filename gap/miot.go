@@ -0,0 +1,104 @@
+package gap
+
+import "math"
+
+// miotProperty describes MIoT-spec object ID from MiBeacon payload
+type miotProperty struct {
+	name   string
+	format byte // u - unsigned, f - float (signed), 0 - without value
+	size   int
+	scale  float32 // 1 - value without scale
+	unit   string
+
+	action string        // event objects have action, value is its attribute
+	values []interface{} // enum objects have values by index, others skipped
+	fixed  Map           // values added to the result, same as legacy objects
+}
+
+// https://iot.mi.com/new/doc/accesses/direct-access/embedded-development/ble/object-definition
+// https://github.com/custom-components/ble_monitor/blob/master/custom_components/ble_monitor/ble_parser/xiaomi.py
+var miotProperties = map[uint16]miotProperty{
+	0x4803: {name: "battery", format: 'u', size: 1, scale: 1, unit: "%"},
+	0x4805: {name: "illuminance", format: 'f', size: 4, scale: 1, unit: "lx"},
+	0x4806: {name: "water_leak", format: 'u', size: 1, scale: 1},
+	0x4808: {name: "humidity", format: 'f', size: 4, scale: 1, unit: "%"},
+	0x4810: {name: "sleep", format: 'u', size: 1, scale: 1},
+	0x4818: {name: "idle_time", format: 'u', size: 2, scale: 1, unit: "s"},
+	0x4819: {name: "occupancy", format: 'u', size: 1, scale: 1},
+	0x481A: {name: "occupancy_time", format: 'u', size: 4, scale: 1, unit: "s"},
+	0x4A01: {name: "battery_low", format: 'u', size: 1, scale: 1},
+	// motion with illuminance data
+	0x4A08: {name: "illuminance", format: 'f', size: 4, scale: 1, unit: "lx", action: "motion", fixed: Map{"motion": 1}},
+	0x4A0C: {name: "button", format: 'u', size: 1, scale: 1, action: "single"},
+	0x4A0D: {name: "button", format: 'u', size: 1, scale: 1, action: "double"},
+	0x4A0E: {name: "button", format: 'u', size: 1, scale: 1, action: "hold"},
+	// 0x00: open the door, 0x01: close the door,
+	// 0x02: not closed after timeout, 0x03: device reset
+	// 1 => true => open, same as 0x1019
+	0x4A0F: {name: "contact", format: 'u', size: 1, scale: 1, values: []interface{}{1, 0}},
+	0x4C01: {name: "temperature", format: 'f', size: 4, scale: 1, unit: "°C"},
+	0x4C02: {name: "humidity", format: 'u', size: 1, scale: 1, unit: "%"},
+	0x4C03: {name: "battery", format: 'u', size: 1, scale: 1, unit: "%"},
+	0x4C08: {name: "humidity", format: 'f', size: 4, scale: 1, unit: "%"},
+	0x4E0C: {name: "button", format: 'u', size: 1, scale: 1, action: "single"},
+	0x4E0D: {name: "button", format: 'u', size: 1, scale: 1, action: "double"},
+	0x4E0E: {name: "button", format: 'u', size: 1, scale: 1, action: "hold"},
+	0x4E16: {name: "occupancy", format: 'u', size: 1, scale: 1},
+	0x4E1C: {action: "reset"},
+}
+
+func miotDecodeObject(obj MiBeaconObject) Map {
+	prop, ok := miotProperties[obj.Eid]
+	if !ok {
+		return nil
+	}
+
+	if prop.format == 0 {
+		return Map{"action": prop.action}
+	}
+
+	if len(obj.Edata) != prop.size {
+		return nil
+	}
+
+	var value uint32
+	for i, v := range obj.Edata {
+		value |= uint32(v) << (8 * i)
+	}
+
+	var result Map
+
+	switch {
+	case prop.values != nil:
+		if int(value) >= len(prop.values) {
+			return nil
+		}
+		result = Map{prop.name: prop.values[value]}
+	case prop.format == 'f':
+		result = Map{prop.name: math.Float32frombits(value) * prop.scale}
+	default:
+		if prop.scale != 1 {
+			result = Map{prop.name: float32(value) * prop.scale}
+		} else {
+			result = Map{prop.name: value}
+		}
+	}
+
+	if prop.action != "" {
+		result["action"] = prop.action
+	}
+	for k, v := range prop.fixed {
+		result[k] = v
+	}
+	return result
+}
+
+// MiotUnit returns unit of MIoT property by state key, empty for unknown key
+func MiotUnit(name string) string {
+	for _, prop := range miotProperties {
+		if prop.name == name && prop.unit != "" {
+			return prop.unit
+		}
+	}
+	return ""
+}
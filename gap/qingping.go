@@ -0,0 +1,79 @@
+package gap
+
+import (
+	"encoding/binary"
+)
+
+// ParseQingping decodes Qingping service data (UUID 0xFDCD), data without len, 0x16 and UUID
+// https://github.com/custom-components/ble_monitor/blob/master/custom_components/ble_monitor/ble_parser/qingping.py
+func ParseQingping(b []byte) Map {
+	// 0      frame control
+	// 1      product ID
+	// 2..7   MAC (reversed)
+	// 8..    objects: 1 byte type, 1 byte len, data
+	if len(b) < 10 {
+		return nil
+	}
+
+	result := Map{}
+
+	i := 8
+	for i+2 <= len(b) {
+		l := int(b[i+1])
+		if i+2+l > len(b) {
+			break
+		}
+
+		data := b[i+2 : i+2+l]
+
+		switch b[i] {
+		case 0x01:
+			if l == 4 {
+				result["temperature"] = float32(int16(binary.LittleEndian.Uint16(data))) / 10
+				result["humidity"] = float32(binary.LittleEndian.Uint16(data[2:])) / 10
+			}
+		case 0x02:
+			if l == 1 {
+				result["battery"] = data[0]
+			}
+		case 0x04:
+			if l == 1 {
+				// 1 => true => open, same as MiBeacon
+				result["contact"] = data[0]
+			}
+		case 0x07:
+			if l == 2 {
+				result["pressure"] = float32(binary.LittleEndian.Uint16(data)) / 10
+			}
+		case 0x08:
+			if l == 4 {
+				result["motion"] = data[0]
+				result["illuminance"] = uint32(data[1]) | uint32(data[2])<<8 | uint32(data[3])<<16
+			}
+		case 0x09:
+			if l == 4 {
+				result["illuminance"] = binary.LittleEndian.Uint32(data)
+			}
+		case 0x11:
+			if l == 1 {
+				result["light"] = data[0]
+			}
+		case 0x12:
+			if l == 4 {
+				result["pm25"] = binary.LittleEndian.Uint16(data)
+				result["pm10"] = binary.LittleEndian.Uint16(data[2:])
+			}
+		case 0x13:
+			if l == 2 {
+				result["co2"] = binary.LittleEndian.Uint16(data)
+			}
+		}
+
+		i += 2 + l
+	}
+
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
@@ -0,0 +1,106 @@
+package gap
+
+import (
+	"encoding/binary"
+)
+
+// ParseRuuvi decodes RuuviTag manufacturer data (company ID 0x0499), data without len, 0xFF and company ID
+// https://docs.ruuvi.com/communication/bluetooth-advertisements
+func ParseRuuvi(b []byte) Map {
+	if len(b) < 1 {
+		return nil
+	}
+
+	switch b[0] {
+	case 3:
+		return ruuviDecodeRAWv1(b)
+	case 5:
+		return ruuviDecodeRAWv2(b)
+	}
+	return nil
+}
+
+func ruuviDecodeRAWv1(b []byte) Map {
+	// 0       0x03
+	// 1       humidity, 0.5%
+	// 2       temperature integer, highest bit is sign
+	// 3       temperature fraction, 0.01 C
+	// 4 5     pressure, Pa - 50000
+	// 6..11   acceleration X, Y, Z, mG
+	// 12 13   battery voltage, mV
+	if len(b) != 14 {
+		return nil
+	}
+
+	temperature := float32(b[2]&0x7F) + float32(b[3])/100
+	if b[2]&0x80 > 0 {
+		temperature = -temperature
+	}
+
+	return Map{
+		"temperature":    temperature,
+		"humidity":       float32(b[1]) / 2,
+		"pressure":       float32(uint32(binary.BigEndian.Uint16(b[4:]))+50000) / 100,
+		"acceleration_x": int16(binary.BigEndian.Uint16(b[6:])),
+		"acceleration_y": int16(binary.BigEndian.Uint16(b[8:])),
+		"acceleration_z": int16(binary.BigEndian.Uint16(b[10:])),
+		"voltage":        binary.BigEndian.Uint16(b[12:]),
+	}
+}
+
+func ruuviDecodeRAWv2(b []byte) Map {
+	// 0       0x05
+	// 1 2     temperature, 0.005 C
+	// 3 4     humidity, 0.0025%
+	// 5 6     pressure, Pa - 50000
+	// 7..12   acceleration X, Y, Z, mG
+	// 13 14   11 bits battery voltage (mV - 1600), 5 bits tx power (dBm + 40) / 2
+	// 15      movement counter
+	// 16 17   measurement sequence
+	// 18..23  MAC
+	if len(b) != 24 {
+		return nil
+	}
+
+	result := Map{}
+
+	// all bits set (or highest for signed values) means invalid or not available value
+	if v := binary.BigEndian.Uint16(b[1:]); v != 0x8000 {
+		result["temperature"] = float32(int16(v)) * 0.005
+	}
+	if v := binary.BigEndian.Uint16(b[3:]); v != 0xFFFF {
+		result["humidity"] = float32(v) * 0.0025
+	}
+	if v := binary.BigEndian.Uint16(b[5:]); v != 0xFFFF {
+		result["pressure"] = float32(uint32(v)+50000) / 100
+	}
+	if v := binary.BigEndian.Uint16(b[7:]); v != 0x8000 {
+		result["acceleration_x"] = int16(v)
+	}
+	if v := binary.BigEndian.Uint16(b[9:]); v != 0x8000 {
+		result["acceleration_y"] = int16(v)
+	}
+	if v := binary.BigEndian.Uint16(b[11:]); v != 0x8000 {
+		result["acceleration_z"] = int16(v)
+	}
+
+	power := binary.BigEndian.Uint16(b[13:])
+	if v := power >> 5; v != 0x7FF {
+		result["voltage"] = v + 1600
+	}
+	if v := power & 0x1F; v != 0x1F {
+		result["tx"] = int8(v)*2 - 40
+	}
+
+	if b[15] != 0xFF {
+		result["movement"] = b[15]
+	}
+	if v := binary.BigEndian.Uint16(b[16:]); v != 0xFFFF {
+		result["seq"] = v
+	}
+
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
@@ -0,0 +1,121 @@
+package gap
+
+// SwitchBot devices use service data (UUID 0xFD3D or old 0x0D00) with device type in first byte
+// and new devices also use manufacturer data (company ID 0x0969) with MAC in first 6 bytes
+// https://github.com/Danielhiversen/pySwitchbot/tree/master/switchbot/adv_parsers
+
+// SwitchBot device types from service data
+const (
+	SwitchBotBot          = 'H'
+	SwitchBotMeter        = 'T'
+	SwitchBotMeterPlus    = 'i'
+	SwitchBotOutdoorMeter = 'w'
+	SwitchBotContact      = 'd'
+	SwitchBotMotion       = 's'
+	SwitchBotCurtain      = 'c'
+)
+
+// SwitchBotModel returns device type from service data without len, 0x16 and UUID
+func SwitchBotModel(service []byte) byte {
+	if len(service) < 1 {
+		return 0
+	}
+	return service[0] & 0x7F
+}
+
+// ParseSwitchBot decodes service data and manufacturer data (both without len, type and UUID/company ID),
+// any of them can be nil
+func ParseSwitchBot(model byte, service []byte, manufacturer []byte) Map {
+	switch model {
+	case SwitchBotBot:
+		if len(service) < 3 {
+			return nil
+		}
+		result := Map{"battery": service[2] & 0x7F}
+		if service[1]&0b10000000 > 0 {
+			// switch mode, state bit is inverted
+			result["mode"] = "switch"
+			if service[1]&0b01000000 > 0 {
+				result["switch"] = 0
+			} else {
+				result["switch"] = 1
+			}
+		} else {
+			result["mode"] = "press"
+		}
+		return result
+
+	case SwitchBotMeter, SwitchBotMeterPlus, SwitchBotOutdoorMeter:
+		var b []byte
+		if len(manufacturer) >= 11 {
+			b = manufacturer[8:11]
+		} else if len(service) >= 6 {
+			b = service[3:6]
+		} else {
+			return nil
+		}
+
+		// 0  bits 0-3 - temperature fraction
+		// 1  bit 7 - temperature sign (1 - positive), bits 0-6 - temperature integer
+		// 2  bits 0-6 - humidity
+		temperature := float32(b[1]&0x7F) + float32(b[0]&0x0F)/10
+		if b[1]&0x80 == 0 {
+			temperature = -temperature
+		}
+
+		result := Map{
+			"temperature": temperature,
+			"humidity":    b[2] & 0x7F,
+		}
+		if len(service) >= 3 {
+			result["battery"] = service[2] & 0x7F
+		}
+		return result
+
+	case SwitchBotContact:
+		if len(service) < 9 {
+			return nil
+		}
+		// 1 => true => open, same as MiBeacon
+		var contact uint8
+		if service[3]&0b10 > 0 {
+			contact = 1
+		}
+		return Map{
+			"battery":      service[2] & 0x7F,
+			"motion":       (service[1] >> 6) & 1,
+			"contact":      contact,
+			"light":        service[3] & 1,
+			"button_count": service[8] & 0x0F,
+		}
+
+	case SwitchBotMotion:
+		if len(service) < 6 {
+			return nil
+		}
+		return Map{
+			"battery": service[2] & 0x7F,
+			"motion":  (service[1] >> 6) & 1,
+			"light":   (service[5] >> 1) & 1,
+		}
+
+	case SwitchBotCurtain:
+		if len(service) < 5 {
+			return nil
+		}
+		position := service[3] & 0x7F
+		if position > 100 {
+			position = 100
+		}
+		return Map{
+			"battery":     service[2] & 0x7F,
+			"calibration": (service[1] >> 6) & 1,
+			"moving":      service[3] >> 7,
+			// device reports closed percent, convert to open percent
+			"position":    100 - position,
+			"light_level": service[4] >> 4,
+		}
+	}
+
+	return nil
+}
@@ -8,13 +8,18 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
+	"github.com/AlexxIT/gw3/mqtt"
+	proto "github.com/huin/mqtt"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"io"
 	"io/ioutil"
 	"log/syslog"
+	"math"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -28,6 +33,10 @@ var (
 func main() {
 	mainInitConfig()
 
+	// restore unsent messages and devices state before first publish
+	mqttRestoreOutbox()
+	bleRestoreDevices()
+
 	shellUpdatePath()
 
 	// kill daemon_miio.sh before kill silabs_ncp_bt
@@ -38,8 +47,8 @@ func main() {
 	btappInit()
 	btchipInit()
 
-	// need to restart zigbee_gw after restart mosquitto
-	if shellRunMosquitto() {
+	// need to restart zigbee_gw after restart mosquitto or run embedded broker
+	if mqttRunBroker() || shellRunMosquitto() {
 		shellKillall("zigbee_gw")
 	}
 
@@ -55,6 +64,8 @@ func main() {
 	go btchipReader()
 	go btappReader()
 
+	go bleAvailabilityChecker()
+
 	select {} // run forever
 }
 
@@ -67,6 +78,17 @@ func mainInitConfig() {
 	flag.DurationVar(&config.discoveryDelay, "dd", time.Minute, "BLE discovery delay")
 	flag.DurationVar(&config.patchDelay, "pd", 5*time.Minute, "Silabs patch delay, 0 - disabled")
 
+	broker := &ConfigMQTT{}
+	flag.StringVar(&broker.URL, "mqtt", "", "MQTT broker URL (default tcp://127.0.0.1:1883)")
+	flag.StringVar(&broker.Username, "mqtt-user", "", "MQTT username")
+	flag.StringVar(&broker.Password, "mqtt-pass", "", "MQTT password")
+	flag.StringVar(&broker.ClientID, "mqtt-id", "", "MQTT client ID (default gw3)")
+	flag.IntVar(&broker.KeepAlive, "mqtt-keepalive", 0, "MQTT keepalive in seconds (default 60)")
+	flag.StringVar(&broker.Prefix, "mqtt-prefix", "", "MQTT base topic (default gw3)")
+	flag.IntVar(&broker.Version, "mqtt-version", 0, "MQTT protocol: 3 - v3.1, 4 - v3.1.1 (default), 5 - v5")
+
+	passwd := flag.String("passwd", "", "Prints password file line for username:password")
+
 	flag.Parse()
 
 	if *v {
@@ -74,12 +96,24 @@ func mainInitConfig() {
 		os.Exit(0)
 	}
 
+	if *passwd != "" {
+		println(mqttPasswordLine(*passwd))
+		os.Exit(0)
+	}
+
 	if data, err := ioutil.ReadFile("/data/gw3.json"); err == nil {
 		if err = json.Unmarshal(data, config); err != nil {
 			log.Panic().Err(err).Send()
 		}
 	}
 
+	// priority: flags, config file, defaults
+	config.broker = ConfigMQTT{URL: "tcp://127.0.0.1:1883", ClientID: "gw3", Prefix: "gw3", Version: 4, KeepAlive: 60}
+	if config.MQTT != nil {
+		config.broker.merge(config.MQTT)
+	}
+	config.broker.merge(broker)
+
 	mainInitLogger(*logs)
 }
 
@@ -146,12 +180,210 @@ func mainInitLogger(logs string) {
 
 type Config struct {
 	Devices        map[string]ConfigDevice `json:"devices,omitempty"`
+	Users          []ConfigUser            `json:"users,omitempty"`
+	Raw            *ConfigRaw              `json:"raw,omitempty"`
+	Discovery      string                  `json:"discovery,omitempty"` // Home Assistant discovery prefix, empty - disabled
+	Availability   *ConfigAvailability     `json:"availability,omitempty"`
+	Persist        *ConfigPersist          `json:"persist,omitempty"`
+	MQTT           *ConfigMQTT             `json:"mqtt,omitempty"`
+	Broker         *ConfigBroker           `json:"broker,omitempty"`
 	discoveryDelay time.Duration
 	patchDelay     time.Duration
+	broker         ConfigMQTT // resolved from defaults, config file and flags, not saved
+
+	// guards Raw, which is replaced from MQTT goroutine and read from BT chip goroutine
+	rawMu sync.RWMutex
+}
+
+// ConfigMQTT - broker connection, prefix is the base topic for all gateway messages
+type ConfigMQTT struct {
+	URL       string `json:"url,omitempty"` // tcp://host:port
+	Username  string `json:"username,omitempty"`
+	Password  string `json:"password,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	KeepAlive int    `json:"keepalive,omitempty"` // seconds
+	Prefix    string `json:"prefix,omitempty"`
+	Version   int    `json:"version,omitempty"` // 3 - MQTT 3.1, 4 - MQTT 3.1.1, 5 - MQTT 5
+	// QoS per topic filter without prefix, like "+/event": 1, other topics use QoS 0
+	QoS map[string]byte `json:"qos,omitempty"`
+	TLS *ConfigTLS      `json:"tls,omitempty"` // for mqtts:// URL
+
+	Outbox *ConfigOutbox `json:"outbox,omitempty"`
+}
+
+// ConfigOutbox - max count of messages kept while disconnected, optional file path
+// and interval of file writes in seconds
+type ConfigOutbox struct {
+	Size     int    `json:"size,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Interval int    `json:"interval,omitempty"`
+}
+
+// ConfigBroker - embedded MQTT broker instead of firmware mosquitto
+type ConfigBroker struct {
+	Enabled      bool   `json:"enabled"`
+	Listen       string `json:"listen,omitempty"`        // default ":1883"
+	PasswordFile string `json:"password_file,omitempty"` // mosquitto format, without file anonymous clients are allowed
+	ACLFile      string `json:"acl_file,omitempty"`      // mosquitto format, without file all topics are allowed
+	Queue        int    `json:"queue,omitempty"`         // QoS 1 messages kept for offline client, default 1000
+}
+
+// ConfigTLS - paths to PEM files, without CA system certificates are used
+type ConfigTLS struct {
+	CA         string `json:"ca,omitempty"`
+	Cert       string `json:"cert,omitempty"` // client certificate for mutual authentication
+	Key        string `json:"key,omitempty"`
+	ServerName string `json:"server_name,omitempty"` // if differs from URL host
+	Insecure   bool   `json:"insecure,omitempty"`    // skip server certificate verification
+}
+
+func (m *ConfigMQTT) merge(other *ConfigMQTT) {
+	if other.URL != "" {
+		m.URL = other.URL
+	}
+	if other.Username != "" {
+		m.Username = other.Username
+	}
+	if other.Password != "" {
+		m.Password = other.Password
+	}
+	if other.ClientID != "" {
+		m.ClientID = other.ClientID
+	}
+	if other.KeepAlive > 0 {
+		m.KeepAlive = other.KeepAlive
+	}
+	if other.Prefix != "" {
+		m.Prefix = strings.Trim(other.Prefix, "/")
+	}
+	if other.Version > 0 {
+		m.Version = other.Version
+	}
+	if other.QoS != nil {
+		m.QoS = other.QoS
+	}
+	if other.TLS != nil {
+		m.TLS = other.TLS
+	}
+	if other.Outbox != nil {
+		m.Outbox = other.Outbox
+	}
+}
+
+// GetQoS returns the highest QoS of filters matching the topic
+func (m *ConfigMQTT) GetQoS(topic string) proto.QosLevel {
+	topic = strings.TrimPrefix(topic, m.Prefix+"/")
+
+	var qos byte
+	for filter, v := range m.QoS {
+		if v > qos && mqtt.Match(filter, topic) {
+			qos = v
+		}
+	}
+	if qos > 2 {
+		qos = 2
+	}
+	return proto.QosLevel(qos)
 }
 
 type ConfigDevice struct {
 	Bindkey string `json:"bindkey,omitempty"`
+	Timeout *int   `json:"timeout,omitempty"` // offline timeout in seconds, 0 - disabled
+}
+
+// ConfigAvailability - offline timeouts in seconds for all devices and per model, 0 - disabled
+type ConfigAvailability struct {
+	Timeout int            `json:"timeout"`
+	Models  map[string]int `json:"models,omitempty"`
+}
+
+// ConfigPersist - devices state snapshot path and write interval in seconds, 0 - disabled
+type ConfigPersist struct {
+	Path     string `json:"path,omitempty"`
+	Interval int    `json:"interval"`
+}
+
+// GetTimeout returns offline timeout for device: from device config, from model config or default
+func (c *Config) GetTimeout(mac string, model string) time.Duration {
+	if device, ok := c.Devices[mac]; ok && device.Timeout != nil {
+		return time.Duration(*device.Timeout) * time.Second
+	}
+	if c.Availability == nil {
+		return 0
+	}
+	if timeout, ok := c.Availability.Models[model]; ok {
+		return time.Duration(timeout) * time.Second
+	}
+	return time.Duration(c.Availability.Timeout) * time.Second
+}
+
+// ConfigUser - Mi Scale user profile for body composition metrics
+type ConfigUser struct {
+	Name      string  `json:"name"`
+	Height    float64 `json:"height"` // cm
+	Age       float64 `json:"age"`
+	Sex       string  `json:"sex"` // male, female
+	WeightMin float64 `json:"weight_min"`
+	WeightMax float64 `json:"weight_max"`
+}
+
+// GetUser returns user with weight range nearest to weight (kg)
+func (c *Config) GetUser(weight float64) *ConfigUser {
+	var user *ConfigUser
+	var delta float64
+	for i, u := range c.Users {
+		if weight < u.WeightMin || weight > u.WeightMax {
+			continue
+		}
+		d := math.Abs(weight - (u.WeightMin+u.WeightMax)/2)
+		if user == nil || d < delta {
+			user = &c.Users[i]
+			delta = d
+		}
+	}
+	return user
+}
+
+// ConfigRaw - publish unhandled BLE advertisements to <prefix>/<mac>/raw topic,
+// empty list allows all values, UUIDs and CIDs in hex: "FE95",
+// advertisement should match all non-empty lists
+type ConfigRaw struct {
+	Enabled  bool     `json:"enabled"`
+	MACs     []string `json:"macs,omitempty"`
+	UUIDs    []string `json:"uuids,omitempty"`
+	CIDs     []string `json:"cids,omitempty"`
+	Interval int      `json:"interval,omitempty"` // seconds between messages from one MAC, 0 - no limit
+}
+
+func (r *ConfigRaw) Test(mac string, uuid uint16, cid uint16) bool {
+	return configContains(r.MACs, mac) &&
+		configContains(r.UUIDs, fmt.Sprintf("%04X", uuid)) &&
+		configContains(r.CIDs, fmt.Sprintf("%04X", cid))
+}
+
+// GetRaw returns current raw mode settings, they can't be changed, only replaced
+func (c *Config) GetRaw() *ConfigRaw {
+	c.rawMu.RLock()
+	defer c.rawMu.RUnlock()
+	return c.Raw
+}
+
+func (c *Config) SetRaw(raw *ConfigRaw) {
+	c.rawMu.Lock()
+	c.Raw = raw
+	c.rawMu.Unlock()
+}
+
+func configContains(items []string, value string) bool {
+	if len(items) == 0 {
+		return true
+	}
+	for _, item := range items {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *Config) GetBindkey(mac string) string {
@@ -171,11 +403,14 @@ func (c *Config) SetBindKey(mac string, bindkey string) {
 			return
 		}
 		device.Bindkey = bindkey
+		c.Devices[mac] = device
 	} else {
 		c.Devices[mac] = ConfigDevice{Bindkey: bindkey}
 	}
 
+	c.rawMu.RLock()
 	data, err := json.Marshal(c)
+	c.rawMu.RUnlock()
 	if err != nil {
 		log.Error().Caller().Err(err).Send()
 		return
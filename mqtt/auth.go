@@ -0,0 +1,274 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	proto "github.com/huin/mqtt"
+)
+
+// An Authenticator checks credentials of connecting clients and access of
+// connected clients to topics. The Server allows everything when it's nil.
+type Authenticator interface {
+	// Login returns proto.RetCodeAccepted, proto.RetCodeBadUsernameOrPassword
+	// or proto.RetCodeNotAuthorized.
+	Login(username, password, clientid string) proto.ReturnCode
+	// Allow returns true if the client can publish (write) to the topic or
+	// receive (read) messages from it.
+	Allow(username, clientid, topic string, write bool) bool
+}
+
+// FileAuth is an Authenticator with mosquitto compatible password and ACL
+// files.
+//
+// Password file has "username:hash" lines, hashes are made by HashPassword
+// or mosquitto_passwd ($6$ and $7$ formats).
+//
+// ACL file has "topic [read|write|readwrite|deny] <filter>" lines for the
+// user from the last "user <username>" line (anonymous before the first one)
+// and "pattern [read|write|readwrite|deny] <filter>" lines for all users,
+// where %u is replaced by username and %c by client id.
+type FileAuth struct {
+	passwords map[string]string // nil - anonymous clients are allowed
+	acl       map[string][]rule // nil - all topics are allowed
+	patterns  []rule
+}
+
+type rule struct {
+	filter      string
+	read, write bool // both false - deny
+}
+
+// NewFileAuth loads password and ACL files, empty path disables the check.
+// ACL file requires password file, because ACL rules trust the username.
+func NewFileAuth(passwordFile, aclFile string) (*FileAuth, error) {
+	if aclFile != "" && passwordFile == "" {
+		return nil, errors.New("ACL file requires password file")
+	}
+
+	a := &FileAuth{}
+
+	if passwordFile != "" {
+		a.passwords = make(map[string]string)
+		err := readLines(passwordFile, func(line string) error {
+			i := strings.IndexByte(line, ':')
+			if i <= 0 {
+				return errors.New("wrong password line")
+			}
+			a.passwords[line[:i]] = line[i+1:]
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if aclFile != "" {
+		a.acl = make(map[string][]rule)
+		user := ""
+		err := readLines(aclFile, func(line string) error {
+			fields := strings.SplitN(line, " ", 2)
+			if len(fields) != 2 {
+				return errors.New("wrong ACL line")
+			}
+			if fields[0] == "user" {
+				user = strings.TrimSpace(fields[1])
+				return nil
+			}
+
+			r, err := parseRule(strings.TrimSpace(fields[1]))
+			if err != nil {
+				return err
+			}
+			switch fields[0] {
+			case "topic":
+				a.acl[user] = append(a.acl[user], r)
+			case "pattern":
+				a.patterns = append(a.patterns, r)
+			default:
+				return errors.New("wrong ACL line")
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// readLines calls fn for each line of the file except empty lines and
+// comments, the error contains the line number.
+func readLines(path string, fn func(line string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if err = fn(line); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseRule parses "[read|write|readwrite|deny] <filter>", readwrite is the
+// default access.
+func parseRule(s string) (rule, error) {
+	r := rule{filter: s, read: true, write: true}
+	if fields := strings.SplitN(s, " ", 2); len(fields) == 2 {
+		switch fields[0] {
+		case "read":
+			r.write = false
+		case "write":
+			r.read = false
+		case "deny":
+			r.read, r.write = false, false
+		}
+		switch fields[0] {
+		case "read", "write", "readwrite", "deny":
+			r.filter = strings.TrimSpace(fields[1])
+		}
+	}
+	if !newWild(r.filter, nil).valid() {
+		return r, errors.New("wrong ACL topic " + r.filter)
+	}
+	return r, nil
+}
+
+// Login implements Authenticator.
+func (a *FileAuth) Login(username, password, clientid string) proto.ReturnCode {
+	if a.passwords == nil {
+		return proto.RetCodeAccepted
+	}
+	if username == "" {
+		return proto.RetCodeNotAuthorized
+	}
+	if hash, ok := a.passwords[username]; ok && checkPassword(password, hash) {
+		return proto.RetCodeAccepted
+	}
+	return proto.RetCodeBadUsernameOrPassword
+}
+
+// Allow implements Authenticator, deny rules have priority.
+func (a *FileAuth) Allow(username, clientid, topic string, write bool) bool {
+	if a.acl == nil {
+		return true
+	}
+
+	rules := a.acl[username]
+	// wildcards in username or client id can't be used in patterns
+	if username != "" && !strings.ContainsAny(username+clientid, "+#/") {
+		for _, r := range a.patterns {
+			r.filter = strings.NewReplacer("%u", username, "%c", clientid).Replace(r.filter)
+			rules = append(rules, r)
+		}
+	}
+
+	allow := false
+	for _, r := range rules {
+		if !Match(r.filter, topic) {
+			continue
+		}
+		if !r.read && !r.write {
+			return false
+		}
+		if write && r.write || !write && r.read {
+			allow = true
+		}
+	}
+	return allow
+}
+
+// HashPassword returns password hash in mosquitto $7$ format
+// (PBKDF2-SHA512) for the password file.
+func HashPassword(password string) string {
+	salt := make([]byte, 12)
+	if _, err := crand.Read(salt); err != nil {
+		panic(err)
+	}
+	const iterations = 101 // the same as mosquitto_passwd
+	hash := pbkdf2([]byte(password), salt, iterations)
+	return fmt.Sprintf(
+		"$7$%d$%s$%s", iterations, base64.StdEncoding.EncodeToString(salt),
+		base64.StdEncoding.EncodeToString(hash),
+	)
+}
+
+// checkPassword supports mosquitto $6$ (salted SHA512) and $7$ hashes.
+func checkPassword(password, hash string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) < 4 || parts[0] != "" {
+		return false
+	}
+
+	var got []byte
+	switch {
+	case parts[1] == "6" && len(parts) == 4:
+		salt, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil {
+			return false
+		}
+		h := sha512.New()
+		h.Write([]byte(password))
+		h.Write(salt)
+		got = h.Sum(nil)
+
+	case parts[1] == "7" && len(parts) == 5:
+		iterations, err := strconv.Atoi(parts[2])
+		if err != nil || iterations < 1 {
+			return false
+		}
+		salt, err := base64.StdEncoding.DecodeString(parts[3])
+		if err != nil {
+			return false
+		}
+		got = pbkdf2([]byte(password), salt, iterations)
+
+	default:
+		return false
+	}
+
+	want, err := base64.StdEncoding.DecodeString(parts[len(parts)-1])
+	return err == nil && subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// pbkdf2 returns the first block of PBKDF2-HMAC-SHA512, the key has the same
+// length as the hash.
+func pbkdf2(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha512.New, password)
+	prf.Write(salt)
+	prf.Write([]byte{0, 0, 0, 1}) // block index
+	u := prf.Sum(nil)
+
+	key := make([]byte, len(u))
+	copy(key, u)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
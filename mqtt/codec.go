@@ -0,0 +1,802 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// Protocol levels from the CONNECT message. The level is negotiated per
+// connection: the server answers in the format of the client's level.
+const (
+	Version31  = 3 // protocol name "MQIsdp"
+	Version311 = 4 // protocol name "MQTT"
+	Version5   = 5 // protocol name "MQTT"
+)
+
+// msgAuth is the MQTT 5 AUTH message type, unknown to proto.
+const msgAuth = proto.MessageType(15)
+
+// maxPacketSize limits the remaining length of received packets, so the
+// declared length (up to 256MB) can't exhaust the memory of the gateway.
+const maxPacketSize = 1 << 20
+
+var (
+	errMalformed   = errors.New("mqtt: malformed packet")
+	errTooLarge    = errors.New("mqtt: packet is too large")
+	errAuthPacket  = errors.New("mqtt: AUTH is not supported")
+	errMessageType = errors.New("mqtt: message type is invalid")
+)
+
+func protocolName(version byte) string {
+	if version == Version31 {
+		return "MQIsdp"
+	}
+	return "MQTT"
+}
+
+// connAckReasons maps MQTT 3.x CONNACK return codes to MQTT 5 reason codes.
+var connAckReasons = [6]byte{0x00, 0x84, 0x85, 0x88, 0x86, 0x87}
+
+// MQTT 5 reason codes used by this package.
+const (
+	reasonDisconnectWithWill = 0x04
+	reasonNotAuthorized      = 0x87
+	reasonBadAuthMethod      = 0x8C
+	reasonSessionTakeover    = 0x8E
+)
+
+// connectError returns the error for a CONNACK return code (MQTT 3.x) or
+// reason code (MQTT 5). Equivalent codes of both versions give the same error.
+func connectError(code proto.ReturnCode) error {
+	if code == 0 {
+		return nil
+	}
+	if int(code) < len(ConnectionErrors) {
+		return ConnectionErrors[code]
+	}
+	for i, reason := range connAckReasons {
+		if byte(code) == reason {
+			return ConnectionErrors[i]
+		}
+	}
+	return fmt.Errorf("Connection Refused: reason code 0x%02X", byte(code))
+}
+
+// UserProperty is an MQTT 5 name-value pair, names can be repeated.
+type UserProperty struct {
+	Key, Value string
+}
+
+// Properties holds the MQTT 5 properties used by this package. The zero value
+// of a field means the property is absent. Other properties are validated
+// while decoding and dropped.
+type Properties struct {
+	PayloadFormat    byte   // 1 - UTF-8 payload
+	MessageExpiry    uint32 // seconds
+	ContentType      string
+	ResponseTopic    string
+	CorrelationData  []byte
+	SessionExpiry    uint32 // seconds
+	AssignedClientID string
+	ServerKeepAlive  uint16 // seconds
+	AuthMethod       string
+	ReasonString     string
+	TopicAlias       uint16
+	WillDelay        uint32 // seconds
+	User             []UserProperty
+}
+
+// MQTT 5 property identifiers.
+const (
+	propPayloadFormat     = 0x01
+	propMessageExpiry     = 0x02
+	propContentType       = 0x03
+	propResponseTopic     = 0x08
+	propCorrelationData   = 0x09
+	propSubscriptionID    = 0x0B
+	propSessionExpiry     = 0x11
+	propAssignedClientID  = 0x12
+	propServerKeepAlive   = 0x13
+	propAuthMethod        = 0x15
+	propAuthData          = 0x16
+	propRequestProblem    = 0x17
+	propWillDelay         = 0x18
+	propRequestResponse   = 0x19
+	propResponseInfo      = 0x1A
+	propServerReference   = 0x1C
+	propReasonString      = 0x1F
+	propReceiveMaximum    = 0x21
+	propTopicAliasMaximum = 0x22
+	propTopicAlias        = 0x23
+	propMaximumQoS        = 0x24
+	propRetainAvailable   = 0x25
+	propUser              = 0x26
+	propMaximumPacketSize = 0x27
+	propWildcardAvailable = 0x28
+	propSubIDAvailable    = 0x29
+	propSharedAvailable   = 0x2A
+)
+
+// value sizes of properties which are skipped, 0 - variable byte integer,
+// -1 - binary data or string
+var propSizes = map[byte]int{
+	propSubscriptionID:    0,
+	propAuthData:          -1,
+	propRequestProblem:    1,
+	propRequestResponse:   1,
+	propResponseInfo:      -1,
+	propServerReference:   -1,
+	propReceiveMaximum:    2,
+	propTopicAliasMaximum: 2,
+	propMaximumQoS:        1,
+	propRetainAvailable:   1,
+	propMaximumPacketSize: 4,
+	propWildcardAvailable: 1,
+	propSubIDAvailable:    1,
+	propSharedAvailable:   1,
+}
+
+func (p *Properties) encode(buf *bytes.Buffer) {
+	if p == nil {
+		buf.WriteByte(0)
+		return
+	}
+
+	b := new(bytes.Buffer)
+	if p.PayloadFormat != 0 {
+		b.WriteByte(propPayloadFormat)
+		b.WriteByte(p.PayloadFormat)
+	}
+	if p.MessageExpiry != 0 {
+		b.WriteByte(propMessageExpiry)
+		writeUint32(b, p.MessageExpiry)
+	}
+	if p.ContentType != "" {
+		b.WriteByte(propContentType)
+		writeString(b, p.ContentType)
+	}
+	if p.ResponseTopic != "" {
+		b.WriteByte(propResponseTopic)
+		writeString(b, p.ResponseTopic)
+	}
+	if p.CorrelationData != nil {
+		b.WriteByte(propCorrelationData)
+		writeBinary(b, p.CorrelationData)
+	}
+	if p.SessionExpiry != 0 {
+		b.WriteByte(propSessionExpiry)
+		writeUint32(b, p.SessionExpiry)
+	}
+	if p.AssignedClientID != "" {
+		b.WriteByte(propAssignedClientID)
+		writeString(b, p.AssignedClientID)
+	}
+	if p.ServerKeepAlive != 0 {
+		b.WriteByte(propServerKeepAlive)
+		writeUint16(b, p.ServerKeepAlive)
+	}
+	if p.AuthMethod != "" {
+		b.WriteByte(propAuthMethod)
+		writeString(b, p.AuthMethod)
+	}
+	if p.ReasonString != "" {
+		b.WriteByte(propReasonString)
+		writeString(b, p.ReasonString)
+	}
+	if p.TopicAlias != 0 {
+		b.WriteByte(propTopicAlias)
+		writeUint16(b, p.TopicAlias)
+	}
+	if p.WillDelay != 0 {
+		b.WriteByte(propWillDelay)
+		writeUint32(b, p.WillDelay)
+	}
+	for _, u := range p.User {
+		b.WriteByte(propUser)
+		writeString(b, u.Key)
+		writeString(b, u.Value)
+	}
+
+	writeVarint(buf, b.Len())
+	buf.Write(b.Bytes())
+}
+
+// A propsPayload carries MQTT 5 PUBLISH properties along with the payload,
+// so they pass through the server to subscribers unchanged. Only the
+// original payload is written to the wire by WritePayload.
+type propsPayload struct {
+	proto.Payload
+	props    *Properties
+	received time.Time
+}
+
+// WithProperties attaches MQTT 5 properties to a PUBLISH message. They are
+// sent on MQTT 5 connections only.
+func WithProperties(m *proto.Publish, props *Properties) *proto.Publish {
+	if p, ok := m.Payload.(*propsPayload); ok {
+		m.Payload = p.Payload
+	}
+	m.Payload = &propsPayload{Payload: m.Payload, props: props, received: time.Now()}
+	return m
+}
+
+// PublishProperties returns MQTT 5 properties of a PUBLISH message, or nil.
+func PublishProperties(m *proto.Publish) *Properties {
+	if p, ok := m.Payload.(*propsPayload); ok {
+		return p.props
+	}
+	return nil
+}
+
+// expired returns true when the message expiry interval has passed.
+func expired(m *proto.Publish) bool {
+	p, ok := m.Payload.(*propsPayload)
+	if !ok || p.props == nil || p.props.MessageExpiry == 0 {
+		return false
+	}
+	return time.Since(p.received) >= time.Duration(p.props.MessageExpiry)*time.Second
+}
+
+// extra holds the MQTT 5 parts of a packet which proto messages can't hold.
+// It is ignored on MQTT 3.x connections.
+type extra struct {
+	reason  byte
+	reasons []byte // UNSUBACK reason codes, one per topic
+	props   Properties
+	will    Properties // CONNECT will properties
+}
+
+// decode reads one message from r in the format of the protocol version.
+// CONNECT is always decoded here because it carries the version, other
+// messages of MQTT 3.x are decoded by proto.
+func decode(r io.Reader, version byte) (proto.Message, *extra, error) {
+	var hdr proto.Header
+	msgType, length, err := hdr.Decode(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if length > maxPacketSize {
+		return nil, nil, errTooLarge
+	}
+
+	data := make([]byte, length)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return nil, nil, err
+	}
+
+	if msgType == proto.MsgConnect {
+		return decodeConnect(hdr, data)
+	}
+
+	if version < Version5 {
+		m, err := proto.NewMessage(msgType)
+		if err != nil {
+			return nil, nil, err
+		}
+		return m, nil, m.Decode(bytes.NewReader(data), hdr, length, proto.DefaultDecoderConfig{})
+	}
+
+	return decode5(msgType, hdr, data)
+}
+
+func decodeConnect(hdr proto.Header, data []byte) (proto.Message, *extra, error) {
+	d := &decoder{b: data}
+	x := &extra{}
+
+	m := &proto.Connect{Header: hdr}
+	m.ProtocolName = d.string()
+	m.ProtocolVersion = d.byte()
+	flags := d.byte()
+	m.KeepAliveTimer = d.uint16()
+	if d.err != nil {
+		return nil, nil, d.err
+	}
+
+	// unknown version, the rest of the message can't be parsed
+	if m.ProtocolVersion < Version31 || m.ProtocolVersion > Version5 {
+		return m, x, nil
+	}
+
+	m.UsernameFlag = flags&0x80 > 0
+	m.PasswordFlag = flags&0x40 > 0
+	m.WillRetain = flags&0x20 > 0
+	m.WillQos = proto.QosLevel(flags & 0x18 >> 3)
+	m.WillFlag = flags&0x04 > 0
+	m.CleanSession = flags&0x02 > 0
+
+	if m.ProtocolVersion == Version5 {
+		x.props = d.props()
+	}
+	m.ClientId = d.string()
+	if m.WillFlag {
+		if m.ProtocolVersion == Version5 {
+			x.will = d.props()
+		}
+		m.WillTopic = d.string()
+		m.WillMessage = string(d.binary())
+	}
+	if m.UsernameFlag {
+		m.Username = d.string()
+	}
+	if m.PasswordFlag {
+		m.Password = string(d.binary())
+	}
+
+	if d.err != nil {
+		return nil, nil, d.err
+	}
+	if len(d.b) > 0 {
+		return nil, nil, errMalformed
+	}
+	return m, x, nil
+}
+
+func decode5(msgType proto.MessageType, hdr proto.Header, data []byte) (proto.Message, *extra, error) {
+	d := &decoder{b: data}
+	x := &extra{}
+
+	var m proto.Message
+
+	switch msgType {
+	case proto.MsgConnAck:
+		flags := d.byte()
+		x.reason = d.byte()
+		// MQTT 3.x servers answer unknown versions without properties
+		if len(d.b) > 0 {
+			x.props = d.props()
+		}
+		m = &proto.ConnAck{
+			Header:         hdr,
+			SessionPresent: flags&0x01 > 0,
+			ReturnCode:     proto.ReturnCode(x.reason),
+		}
+
+	case proto.MsgPublish:
+		p := &proto.Publish{Header: hdr}
+		p.TopicName = d.string()
+		if hdr.QosLevel.HasId() {
+			p.MessageId = d.uint16()
+		}
+		props := d.props()
+		p.Payload = &propsPayload{
+			Payload:  proto.BytesPayload(d.b),
+			props:    &props,
+			received: time.Now(),
+		}
+		m = p
+
+	case proto.MsgPubAck, proto.MsgPubRec, proto.MsgPubRel, proto.MsgPubComp:
+		id := d.uint16()
+		// reason code and properties can be omitted
+		if len(d.b) > 0 {
+			x.reason = d.byte()
+		}
+		if len(d.b) > 0 {
+			x.props = d.props()
+		}
+		switch msgType {
+		case proto.MsgPubAck:
+			m = &proto.PubAck{Header: hdr, MessageId: id}
+		case proto.MsgPubRec:
+			m = &proto.PubRec{Header: hdr, MessageId: id}
+		case proto.MsgPubRel:
+			m = &proto.PubRel{Header: hdr, MessageId: id}
+		case proto.MsgPubComp:
+			m = &proto.PubComp{Header: hdr, MessageId: id}
+		}
+
+	case proto.MsgSubscribe:
+		s := &proto.Subscribe{Header: hdr}
+		s.MessageId = d.uint16()
+		x.props = d.props()
+		for len(d.b) > 0 && d.err == nil {
+			topic := d.string()
+			// bits 2-5 are options: no local, retain as published and
+			// retain handling, messages are never echoed by this server
+			qos := proto.QosLevel(d.byte() & 0x03)
+			s.Topics = append(s.Topics, proto.TopicQos{Topic: topic, Qos: qos})
+		}
+		m = s
+
+	case proto.MsgSubAck:
+		s := &proto.SubAck{Header: hdr}
+		s.MessageId = d.uint16()
+		x.props = d.props()
+		for _, b := range d.b {
+			s.TopicsQos = append(s.TopicsQos, proto.QosLevel(b))
+		}
+		m = s
+
+	case proto.MsgUnsubscribe:
+		u := &proto.Unsubscribe{Header: hdr}
+		u.MessageId = d.uint16()
+		x.props = d.props()
+		for len(d.b) > 0 && d.err == nil {
+			u.Topics = append(u.Topics, d.string())
+		}
+		m = u
+
+	case proto.MsgUnsubAck:
+		u := &proto.UnsubAck{Header: hdr}
+		u.MessageId = d.uint16()
+		x.props = d.props()
+		x.reasons = d.b
+		m = u
+
+	case proto.MsgPingReq:
+		m = &proto.PingReq{Header: hdr}
+
+	case proto.MsgPingResp:
+		m = &proto.PingResp{Header: hdr}
+
+	case proto.MsgDisconnect:
+		if len(d.b) > 0 {
+			x.reason = d.byte()
+		}
+		if len(d.b) > 0 {
+			x.props = d.props()
+		}
+		m = &proto.Disconnect{Header: hdr}
+
+	case msgAuth:
+		return nil, nil, errAuthPacket
+
+	default:
+		return nil, nil, errMessageType
+	}
+
+	if d.err != nil {
+		return nil, nil, d.err
+	}
+	return m, x, nil
+}
+
+// encode writes the message to w in the format of the protocol version,
+// x can be nil.
+func encode(w io.Writer, m proto.Message, version byte, x *extra) error {
+	if version < Version5 {
+		// propsPayload writes only the original payload
+		return m.Encode(w)
+	}
+
+	if x == nil {
+		x = &extra{}
+	}
+
+	buf := new(bytes.Buffer)
+
+	var hdr *proto.Header
+	var msgType proto.MessageType
+	var payload proto.Payload
+
+	switch m := m.(type) {
+	case *proto.Connect:
+		hdr, msgType = &m.Header, proto.MsgConnect
+
+		flags := boolToByte(m.UsernameFlag) << 7
+		flags |= boolToByte(m.PasswordFlag) << 6
+		flags |= boolToByte(m.WillRetain) << 5
+		flags |= byte(m.WillQos) << 3
+		flags |= boolToByte(m.WillFlag) << 2
+		flags |= boolToByte(m.CleanSession) << 1
+
+		writeString(buf, m.ProtocolName)
+		buf.WriteByte(m.ProtocolVersion)
+		buf.WriteByte(flags)
+		writeUint16(buf, m.KeepAliveTimer)
+		x.props.encode(buf)
+		writeString(buf, m.ClientId)
+		if m.WillFlag {
+			x.will.encode(buf)
+			writeString(buf, m.WillTopic)
+			writeString(buf, m.WillMessage)
+		}
+		if m.UsernameFlag {
+			writeString(buf, m.Username)
+		}
+		if m.PasswordFlag {
+			writeString(buf, m.Password)
+		}
+
+	case *proto.ConnAck:
+		hdr, msgType = &m.Header, proto.MsgConnAck
+
+		reason := x.reason
+		if reason == 0 && int(m.ReturnCode) < len(connAckReasons) {
+			reason = connAckReasons[m.ReturnCode]
+		}
+		buf.WriteByte(boolToByte(m.SessionPresent))
+		buf.WriteByte(reason)
+		x.props.encode(buf)
+
+	case *proto.Publish:
+		hdr, msgType = &m.Header, proto.MsgPublish
+
+		writeString(buf, m.TopicName)
+		if m.QosLevel.HasId() {
+			writeUint16(buf, m.MessageId)
+		}
+
+		payload = m.Payload
+		if p, ok := m.Payload.(*propsPayload); ok {
+			payload = p.Payload
+			if p.props != nil {
+				props := *p.props
+				if props.MessageExpiry > 0 {
+					// subscribers get the remaining lifetime of the message
+					elapsed := uint32(time.Since(p.received) / time.Second)
+					if elapsed < props.MessageExpiry {
+						props.MessageExpiry -= elapsed
+					} else {
+						props.MessageExpiry = 1
+					}
+				}
+				props.encode(buf)
+				break
+			}
+		}
+		buf.WriteByte(0)
+
+	case *proto.PubAck:
+		hdr, msgType = &m.Header, proto.MsgPubAck
+		encodeAck5(buf, m.MessageId, x)
+	case *proto.PubRec:
+		hdr, msgType = &m.Header, proto.MsgPubRec
+		encodeAck5(buf, m.MessageId, x)
+	case *proto.PubRel:
+		hdr, msgType = &m.Header, proto.MsgPubRel
+		encodeAck5(buf, m.MessageId, x)
+	case *proto.PubComp:
+		hdr, msgType = &m.Header, proto.MsgPubComp
+		encodeAck5(buf, m.MessageId, x)
+
+	case *proto.Subscribe:
+		hdr, msgType = &m.Header, proto.MsgSubscribe
+
+		writeUint16(buf, m.MessageId)
+		x.props.encode(buf)
+		for _, tq := range m.Topics {
+			writeString(buf, tq.Topic)
+			buf.WriteByte(byte(tq.Qos))
+		}
+
+	case *proto.SubAck:
+		hdr, msgType = &m.Header, proto.MsgSubAck
+
+		writeUint16(buf, m.MessageId)
+		x.props.encode(buf)
+		for _, qos := range m.TopicsQos {
+			buf.WriteByte(byte(qos))
+		}
+
+	case *proto.Unsubscribe:
+		hdr, msgType = &m.Header, proto.MsgUnsubscribe
+
+		writeUint16(buf, m.MessageId)
+		x.props.encode(buf)
+		for _, topic := range m.Topics {
+			writeString(buf, topic)
+		}
+
+	case *proto.UnsubAck:
+		hdr, msgType = &m.Header, proto.MsgUnsubAck
+
+		writeUint16(buf, m.MessageId)
+		x.props.encode(buf)
+		buf.Write(x.reasons)
+
+	case *proto.Disconnect:
+		hdr, msgType = &m.Header, proto.MsgDisconnect
+
+		if x.reason != 0 || !x.props.empty() {
+			buf.WriteByte(x.reason)
+			x.props.encode(buf)
+		}
+
+	default:
+		// PINGREQ and PINGRESP are the same in all versions
+		return m.Encode(w)
+	}
+
+	length := buf.Len()
+	if payload != nil {
+		length += payload.Size()
+	}
+	if length > proto.MaxPayloadSize {
+		return errors.New("mqtt: message is too long")
+	}
+
+	if err := hdr.Encode(w, msgType, int32(length)); err != nil {
+		return err
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if payload != nil {
+		return payload.WritePayload(w)
+	}
+	return nil
+}
+
+// encodeAck5 writes PUBACK, PUBREC, PUBREL or PUBCOMP, reason code and
+// properties are omitted on success.
+func encodeAck5(buf *bytes.Buffer, id uint16, x *extra) {
+	writeUint16(buf, id)
+	if x.reason != 0 || !x.props.empty() {
+		buf.WriteByte(x.reason)
+		x.props.encode(buf)
+	}
+}
+
+func (p *Properties) empty() bool {
+	b := new(bytes.Buffer)
+	p.encode(b)
+	return b.Len() == 1
+}
+
+// A decoder reads MQTT data types from a packet, the first error stops it.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.b) {
+		d.err = errMalformed
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) byte() byte {
+	if v := d.take(1); d.err == nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if v := d.take(2); d.err == nil {
+		return binary.BigEndian.Uint16(v)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if v := d.take(4); d.err == nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (d *decoder) varint() int {
+	var v int
+	for i := 0; i < 4; i++ {
+		b := d.byte()
+		v |= int(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			return v
+		}
+	}
+	if d.err == nil {
+		d.err = errMalformed
+	}
+	return 0
+}
+
+func (d *decoder) binary() []byte {
+	return d.take(int(d.uint16()))
+}
+
+func (d *decoder) string() string {
+	return string(d.binary())
+}
+
+func (d *decoder) props() (p Properties) {
+	n := d.varint()
+	pd := &decoder{b: d.take(n)}
+	if d.err != nil {
+		return
+	}
+
+	for len(pd.b) > 0 && pd.err == nil {
+		id := pd.byte()
+		switch id {
+		case propPayloadFormat:
+			p.PayloadFormat = pd.byte()
+		case propMessageExpiry:
+			p.MessageExpiry = pd.uint32()
+		case propContentType:
+			p.ContentType = pd.string()
+		case propResponseTopic:
+			p.ResponseTopic = pd.string()
+		case propCorrelationData:
+			p.CorrelationData = pd.binary()
+		case propSessionExpiry:
+			p.SessionExpiry = pd.uint32()
+		case propAssignedClientID:
+			p.AssignedClientID = pd.string()
+		case propServerKeepAlive:
+			p.ServerKeepAlive = pd.uint16()
+		case propAuthMethod:
+			p.AuthMethod = pd.string()
+		case propReasonString:
+			p.ReasonString = pd.string()
+		case propTopicAlias:
+			p.TopicAlias = pd.uint16()
+		case propWillDelay:
+			p.WillDelay = pd.uint32()
+		case propUser:
+			p.User = append(p.User, UserProperty{Key: pd.string(), Value: pd.string()})
+		default:
+			size, ok := propSizes[id]
+			switch {
+			case !ok:
+				pd.err = errMalformed
+			case size == 0:
+				pd.varint()
+			case size == -1:
+				pd.binary()
+			default:
+				pd.take(size)
+			}
+		}
+	}
+
+	d.err = pd.err
+	return
+}
+
+func writeUint16(buf *bytes.Buffer, v uint16) {
+	buf.WriteByte(byte(v >> 8))
+	buf.WriteByte(byte(v))
+}
+
+func writeUint32(buf *bytes.Buffer, v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	buf.Write(b[:])
+}
+
+func writeVarint(buf *bytes.Buffer, v int) {
+	for {
+		b := byte(v & 0x7F)
+		v >>= 7
+		if v > 0 {
+			b |= 0x80
+		}
+		buf.WriteByte(b)
+		if v == 0 {
+			return
+		}
+	}
+}
+
+func writeBinary(buf *bytes.Buffer, v []byte) {
+	writeUint16(buf, uint16(len(v)))
+	buf.Write(v)
+}
+
+func writeString(buf *bytes.Buffer, v string) {
+	writeUint16(buf, uint16(len(v)))
+	buf.WriteString(v)
+}
+
+func boolToByte(v bool) byte {
+	if v {
+		return 1
+	}
+	return 0
+}
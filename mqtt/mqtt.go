@@ -10,6 +10,7 @@ import (
 	"math/rand"
 	"net"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -112,6 +113,7 @@ type subscriptions struct {
 	subs      map[string][]*incomingConn
 	wildcards []wild
 	retain    map[string]retain
+	sessions  map[string]*session // by client id
 	stats     *stats
 }
 
@@ -121,10 +123,11 @@ const postQueue = 100
 
 func newSubscriptions(workers int) *subscriptions {
 	s := &subscriptions{
-		subs:    make(map[string][]*incomingConn),
-		retain:  make(map[string]retain),
-		posts:   make(chan post, postQueue),
-		workers: workers,
+		subs:     make(map[string][]*incomingConn),
+		retain:   make(map[string]retain),
+		sessions: make(map[string]*session),
+		posts:    make(chan post, postQueue),
+		workers:  workers,
 	}
 	for i := 0; i < s.workers; i++ {
 		go s.run(i)
@@ -136,28 +139,53 @@ func (s *subscriptions) sendRetain(topic string, c *incomingConn) {
 	s.mu.Lock()
 	var tlist []string
 	if isWildcard(topic) {
-
-		// TODO: select matching topics from the retain map
+		if w := newWild(topic, c); w.valid() {
+			for t := range s.retain {
+				if w.matches(strings.Split(t, "/")) {
+					tlist = append(tlist, t)
+				}
+			}
+			sort.Strings(tlist)
+		}
 	} else {
 		tlist = []string{topic}
 	}
 	for _, t := range tlist {
 		if r, ok := s.retain[t]; ok {
-			c.submit(&r.m)
+			if expired(&r.m) {
+				delete(s.retain, t)
+				continue
+			}
+			if c.allowed(t, false) {
+				c.deliver(&r.m)
+			}
 		}
 	}
 	s.mu.Unlock()
 }
 
+// add subscribes the connection to the topic once, repeated SUBSCRIBE (or
+// restored session) only replaces QoS, which is kept in the session.
 func (s *subscriptions) add(topic string, c *incomingConn) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if isWildcard(topic) {
 		w := newWild(topic, c)
-		if w.valid() {
-			s.wildcards = append(s.wildcards, w)
+		if !w.valid() {
+			return
+		}
+		for _, w2 := range s.wildcards {
+			if w2.c == c && strings.Join(w2.wild, "/") == topic {
+				return
+			}
 		}
+		s.wildcards = append(s.wildcards, w)
 	} else {
+		for _, c2 := range s.subs[topic] {
+			if c2 == c {
+				return
+			}
+		}
 		s.subs[topic] = append(s.subs[topic], c)
 	}
 }
@@ -172,6 +200,13 @@ func newWild(topic string, c *incomingConn) wild {
 }
 
 func (w wild) matches(parts []string) bool {
+	// topics starting with $ (like $SYS) are not matched by wildcards
+	// at the first level: "#" and "+/..." don't match them
+	if len(parts) > 0 && strings.HasPrefix(parts[0], "$") &&
+		(w.wild[0] == "#" || w.wild[0] == "+") {
+		return false
+	}
+
 	i := 0
 	for i < len(parts) {
 		// topic is longer, no match
@@ -279,15 +314,6 @@ func (s *subscriptions) run(id int) {
 		isRetain := post.m.Header.Retain
 		post.m.Header.Retain = false
 
-		// Handle "retain with payload size zero = delete retain".
-		// Once the delete is done, return instead of continuing.
-		if isRetain && post.m.Payload.Size() == 0 {
-			s.mu.Lock()
-			delete(s.retain, post.m.TopicName)
-			s.mu.Unlock()
-			return
-		}
-
 		// Find all the connections that should be notified of this message.
 		conns := s.subscribers(post.m.TopicName)
 
@@ -298,24 +324,85 @@ func (s *subscriptions) run(id int) {
 				continue
 			}
 
-			if c != nil {
-				c.submit(post.m)
+			if c != nil && c.allowed(post.m.TopicName, false) {
+				c.deliver(post.m)
+			}
+		}
+
+		// Queue QoS 1 messages for offline clients with persistent session.
+		if post.m.QosLevel != proto.QosAtMostOnce {
+			for _, sess := range s.offline(post.m.TopicName) {
+				sess.deliver(post.m)
 			}
 		}
 
 		if isRetain {
 			s.mu.Lock()
-			// Save a copy of it, and set that copy's Retain to true, so that
-			// when we send it out later we notify new subscribers that this
-			// is an old message.
-			msg := *post.m
-			msg.Header.Retain = true
-			s.retain[post.m.TopicName] = retain{m: msg}
+			if post.m.Payload.Size() == 0 {
+				// Handle "retain with payload size zero = delete retain",
+				// the message itself is delivered as normal.
+				delete(s.retain, post.m.TopicName)
+			} else {
+				// Save a copy of it, and set that copy's Retain to true, so that
+				// when we send it out later we notify new subscribers that this
+				// is an old message.
+				msg := *post.m
+				msg.Header.Retain = true
+				s.retain[post.m.TopicName] = retain{m: msg}
+			}
 			s.mu.Unlock()
 		}
 	}
 }
 
+// session returns the existing session of the client or creates a new one,
+// present is true for the existing session.
+func (s *subscriptions) session(c *incomingConn, clean, persistent bool, expiry time.Duration) (sess *session, present bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess = s.sessions[c.clientid]; sess != nil && !clean && !sess.expired(time.Now()) {
+		sess.update(c, persistent, expiry)
+		return sess, true
+	}
+
+	sess = newSession(c, persistent, expiry)
+	s.sessions[c.clientid] = sess
+	return sess, false
+}
+
+// endSession removes the session after disconnect, if it's not persistent.
+func (s *subscriptions) endSession(sess *session) {
+	s.mu.Lock()
+	if s.sessions[sess.clientid] == sess && !sess.isPersistent() && !sess.online() {
+		delete(s.sessions, sess.clientid)
+	}
+	s.mu.Unlock()
+}
+
+// offline returns persistent sessions of disconnected clients, which are
+// subscribed to the topic with QoS 1. Expired sessions are removed.
+func (s *subscriptions) offline(topic string) []*session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	var res []*session
+	for clientid, sess := range s.sessions {
+		if sess.expired(now) {
+			log.Print("Session of ", clientid, " expired")
+			delete(s.sessions, clientid)
+			continue
+		}
+		if sess.isPersistent() && !sess.online() &&
+			sess.qos(topic) != proto.QosAtMostOnce && sess.allowed(topic) {
+			res = append(res, sess)
+		}
+	}
+	return res
+}
+
 func (s *subscriptions) submit(c *incomingConn, m *proto.Publish) {
 	s.posts <- post{c: c, m: m}
 }
@@ -334,6 +421,8 @@ type Server struct {
 	Done          chan struct{}
 	StatsInterval time.Duration // Defaults to 10 seconds. Must be set using sync/atomic.StoreInt64().
 	Dump          bool          // When true, dump the messages in and out.
+	Auth          Authenticator // When not nil, checks clients and their access to topics. Must be set before Start.
+	QueueLength   int           // Max QoS 1 messages kept for a client with persistent session, defaults to 1000.
 	rand          *rand.Rand
 }
 
@@ -377,20 +466,29 @@ func (s *Server) Start() {
 				break
 			}
 
-			cli := s.newIncomingConn(conn)
-			s.stats.clientConnect()
-			cli.start()
+			s.ServeConn(conn)
 		}
 		close(s.Done)
 	}()
 }
 
+// ServeConn handles a connection which was not accepted from the listener,
+// e.g. one end of net.Pipe for the in-process client.
+func (s *Server) ServeConn(conn net.Conn) {
+	cli := s.newIncomingConn(conn)
+	s.stats.clientConnect()
+	cli.start()
+}
+
 // An IncomingConn represents a connection into a Server.
 type incomingConn struct {
 	svr      *Server
 	conn     net.Conn
 	jobs     chan job
 	clientid string
+	username string
+	version  byte     // protocol level, set by reader before CONNACK
+	session  *session // set by reader after successful CONNECT
 	Done     chan struct{}
 }
 
@@ -423,6 +521,7 @@ func (r receipt) wait() {
 type job struct {
 	m proto.Message
 	r receipt
+	x *extra // MQTT 5 reason codes and properties
 }
 
 // Start reading and writing on this connection.
@@ -450,20 +549,49 @@ func (c *incomingConn) add() *incomingConn {
 // Delete a connection; the connection must be closed by the caller first.
 func (c *incomingConn) del() {
 	clientsMu.Lock()
-	delete(clients, c.clientid)
+	// refused connection doesn't own the client id
+	if clients[c.clientid] == c {
+		delete(clients, c.clientid)
+	}
 	clientsMu.Unlock()
 	return
 }
 
+// deliver sends the message to the client with QoS of its subscription,
+// but not higher than QoS of the message.
+func (c *incomingConn) deliver(m *proto.Publish) {
+	if m.QosLevel != proto.QosAtMostOnce && c.session.qos(m.TopicName) != proto.QosAtMostOnce {
+		c.session.deliver(m)
+		return
+	}
+	msg := *m
+	msg.Header = header(dupFalse, proto.QosAtMostOnce, retainFlag(m.Retain))
+	msg.MessageId = 0
+	c.submit(&msg)
+}
+
+// allowed checks access of the client to the topic, write - PUBLISH,
+// otherwise receiving the message.
+func (c *incomingConn) allowed(topic string, write bool) bool {
+	return c.svr.Auth == nil || c.svr.Auth.Allow(c.username, c.clientid, topic, write)
+}
+
 // Queue a message; no notification of sending is done.
-func (c *incomingConn) submit(m proto.Message) {
-	j := job{m: m}
+func (c *incomingConn) submit(m proto.Message) bool {
+	return c.submitExtra(m, nil)
+}
+
+// Queue a message with MQTT 5 reason codes and properties, returns false
+// if the queue is full and the message is dropped.
+func (c *incomingConn) submitExtra(m proto.Message, x *extra) bool {
+	j := job{m: m, x: x}
 	select {
 	case c.jobs <- j:
+		return true
 	default:
 		log.Print(c, ": failed to submit message")
+		return false
 	}
-	return
 }
 
 func (c *incomingConn) String() string {
@@ -472,8 +600,8 @@ func (c *incomingConn) String() string {
 
 // Queue a message, returns a channel that will be readable
 // when the message is sent.
-func (c *incomingConn) submitSync(m proto.Message) receipt {
-	j := job{m: m, r: make(receipt)}
+func (c *incomingConn) submitSync(m proto.Message, x *extra) receipt {
+	j := job{m: m, r: make(receipt), x: x}
 	c.jobs <- j
 	return j.r
 }
@@ -487,9 +615,37 @@ func (c *incomingConn) reader() {
 		close(c.jobs)
 	}()
 
+	defer func() {
+		if c.session != nil {
+			c.session.detach(c)
+			c.svr.subs.endSession(c.session)
+		}
+	}()
+
+	// Last will, published when connection is lost without DISCONNECT.
+	var will *proto.Publish
+	defer func() {
+		if will != nil {
+			log.Print("Publish last will of ", c.clientid, " to ", will.TopicName)
+			c.svr.subs.submit(c, will)
+		}
+	}()
+
+	// QoS 2 messages delivered to subscribers, but not yet released by client
+	received := make(map[uint16]bool)
+
+	// CONNECT should come in the same time as CONNACK for the client, then
+	// any packet should come in one and a half keepalive, see MQTT-3.1.2-24
+	timeout := clientTimeout
+
 	for {
-		// TODO: timeout (first message and/or keepalives)
-		m, err := proto.DecodeOneMessage(c.conn, nil)
+		if timeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(timeout))
+		} else {
+			c.conn.SetReadDeadline(time.Time{})
+		}
+
+		m, x, err := decode(c.conn, c.version)
 		if err != nil {
 			if err == io.EOF {
 				return
@@ -497,6 +653,11 @@ func (c *incomingConn) reader() {
 			if strings.HasSuffix(err.Error(), "use of closed network connection") {
 				return
 			}
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				// unexpected disconnect, the will is published
+				log.Printf("Client %v has exceeded timeout, disconnecting.", c.clientid)
+				return
+			}
 			log.Print("reader: ", err)
 			return
 		}
@@ -506,67 +667,173 @@ func (c *incomingConn) reader() {
 			log.Printf("dump  in: %T", m)
 		}
 
+		// the first message must be CONNECT, see MQTT-3.1.0-1
+		if _, ok := m.(*proto.Connect); !ok && c.session == nil {
+			log.Printf("reader: %T before CONNECT", m)
+			return
+		}
+
 		switch m := m.(type) {
 		case *proto.Connect:
+			if c.session != nil {
+				// second CONNECT is a protocol violation, see MQTT-3.1.0-2
+				log.Print("reader: second CONNECT")
+				return
+			}
+
 			rc := proto.RetCodeAccepted
+			ack := &extra{}
 
-			if m.ProtocolName != "MQIsdp" ||
-				m.ProtocolVersion != 3 {
+			if m.ProtocolVersion < Version31 || m.ProtocolVersion > Version5 ||
+				m.ProtocolName != protocolName(m.ProtocolVersion) {
 				log.Print("reader: reject connection from ", m.ProtocolName, " version ", m.ProtocolVersion)
 				rc = proto.RetCodeUnacceptableProtocolVersion
+			} else {
+				// answer in the format of the client version
+				c.version = m.ProtocolVersion
 			}
 
 			// Check client id.
-			if len(m.ClientId) < 1 || len(m.ClientId) > 23 {
-				rc = proto.RetCodeIdentifierRejected
+			if rc == proto.RetCodeAccepted {
+				switch {
+				case m.ClientId == "" && m.ProtocolVersion >= Version311 && m.CleanSession:
+					// MQTT 3.1.1 allows the server to assign client id
+					m.ClientId = fmt.Sprint("auto-", rand.Int63())
+					ack.props.AssignedClientID = m.ClientId
+				case len(m.ClientId) < 1 || m.ProtocolVersion == Version31 && len(m.ClientId) > 23:
+					rc = proto.RetCodeIdentifierRejected
+				case x.props.AuthMethod != "":
+					// enhanced authentication is not supported
+					rc = proto.RetCodeNotAuthorized
+					ack.reason = reasonBadAuthMethod
+				case c.svr.Auth != nil:
+					rc = c.svr.Auth.Login(m.Username, m.Password, m.ClientId)
+				}
 			}
 			c.clientid = m.ClientId
-
-			// Disconnect existing connections.
-			if existing := c.add(); existing != nil {
-				disconnect := &proto.Disconnect{}
-				r := existing.submitSync(disconnect)
-				r.wait()
-				c.add()
+			c.username = m.Username
+
+			// Disconnect existing connections, refused client can't do it.
+			if rc == proto.RetCodeAccepted {
+				if existing := c.add(); existing != nil {
+					disconnect := &proto.Disconnect{}
+					r := existing.submitSync(disconnect, &extra{reason: reasonSessionTakeover})
+					r.wait()
+					c.add()
+				}
 			}
 
-			// TODO: Last will
+			if rc == proto.RetCodeAccepted && m.WillFlag {
+				if isWildcard(m.WillTopic) || m.WillTopic == "" {
+					log.Print("reader: ignoring last will with topic ", m.WillTopic)
+				} else if !c.allowed(m.WillTopic, true) {
+					log.Printf("Denied last will from %v (%v) to %v", c.clientid, c.username, m.WillTopic)
+				} else {
+					will = &proto.Publish{
+						Header:    header(dupFalse, m.WillQos, retainFlag(m.WillRetain)),
+						TopicName: m.WillTopic,
+						Payload:   proto.BytesPayload(m.WillMessage),
+					}
+					if c.version == Version5 {
+						props := x.will
+						WithProperties(will, &props)
+					}
+				}
+			}
 
 			connack := &proto.ConnAck{
 				ReturnCode: rc,
 			}
-			c.submit(connack)
 
 			// close connection if it was a bad connect
 			if rc != proto.RetCodeAccepted {
-				log.Printf("Connection refused for %v: %v", c.conn.RemoteAddr(), ConnectionErrors[rc])
+				// make sure client gets the reason before close
+				c.submitSync(connack, ack).wait()
+				log.Printf("Connection refused for %v as %v (%v): %v", c.conn.RemoteAddr(), c.clientid, c.username, ConnectionErrors[rc])
 				return
 			}
 
+			// MQTT 5 session lives after disconnect only with expiry interval
+			persistent := !m.CleanSession
+			var expiry time.Duration
+			if c.version == Version5 {
+				persistent = x.props.SessionExpiry > 0
+				// 0xFFFFFFFF - the session doesn't expire
+				if x.props.SessionExpiry != 0xFFFFFFFF {
+					expiry = time.Duration(x.props.SessionExpiry) * time.Second
+				}
+			}
+			var present bool
+			c.session, present = c.svr.subs.session(c, m.CleanSession, persistent, expiry)
+			connack.SessionPresent = present && c.version >= Version311
+
+			c.submitExtra(connack, ack)
+
+			// Restore subscriptions and send messages kept while client was offline.
+			if present {
+				for _, topic := range c.session.topics() {
+					c.svr.subs.add(topic, c)
+				}
+			}
+			c.session.attach(c)
+
+			timeout = time.Duration(m.KeepAliveTimer) * time.Second * 3 / 2
+
 			// Log in mosquitto format.
 			clean := 0
 			if m.CleanSession {
 				clean = 1
 			}
-			log.Printf("New client connected from %v as %v (c%v, k%v).", c.conn.RemoteAddr(), c.clientid, clean, m.KeepAliveTimer)
+			log.Printf("New client connected from %v as %v (p%v, c%v, k%v).", c.conn.RemoteAddr(), c.clientid, c.version, clean, m.KeepAliveTimer)
 
 		case *proto.Publish:
-			// TODO: Proper QoS support
-			if m.Header.QosLevel != proto.QosAtMostOnce {
-				log.Printf("reader: no support for QoS %v yet", m.Header.QosLevel)
-				return
-			}
 			if m.Header.QosLevel != proto.QosAtMostOnce && m.MessageId == 0 {
 				// Invalid message ID. See MQTT-2.3.1-1.
 				log.Printf("reader: invalid MessageId in PUBLISH.")
 				return
 			}
-			if isWildcard(m.TopicName) {
-				log.Print("reader: ignoring PUBLISH with wildcard topic ", m.TopicName)
-			} else {
-				c.svr.subs.submit(c, m)
+			if m.TopicName == "" {
+				// MQTT 5 topic alias, server doesn't allow them
+				log.Printf("reader: PUBLISH without topic name.")
+				return
+			}
+
+			// MQTT 5 client gets the reason in PUBACK or PUBREC
+			ack := &extra{}
+
+			// client resends QoS 2 message until PUBREC, deliver it only once
+			if !received[m.MessageId] {
+				if isWildcard(m.TopicName) {
+					log.Print("reader: ignoring PUBLISH with wildcard topic ", m.TopicName)
+				} else if !c.allowed(m.TopicName, true) {
+					log.Printf("Denied PUBLISH from %v (%v) to %v", c.clientid, c.username, m.TopicName)
+					ack.reason = reasonNotAuthorized
+				} else {
+					// subscribers get QoS 0 or QoS 1 copies, see incomingConn.deliver
+					msg := *m
+					msg.Header = header(dupFalse, m.QosLevel, retainFlag(m.Retain))
+					msg.MessageId = 0
+					c.svr.subs.submit(c, &msg)
+				}
+			}
+
+			switch m.Header.QosLevel {
+			case proto.QosAtLeastOnce:
+				c.submitExtra(&proto.PubAck{MessageId: m.MessageId}, ack)
+			case proto.QosExactlyOnce:
+				// PUBREL doesn't follow the error reason
+				if ack.reason == 0 {
+					received[m.MessageId] = true
+				}
+				c.submitExtra(&proto.PubRec{MessageId: m.MessageId}, ack)
 			}
-			c.submit(&proto.PubAck{MessageId: m.MessageId})
+
+		case *proto.PubAck:
+			c.session.ack(m.MessageId)
+
+		case *proto.PubRel:
+			delete(received, m.MessageId)
+			c.submit(&proto.PubComp{MessageId: m.MessageId})
 
 		case *proto.PingReq:
 			c.submit(&proto.PingResp{})
@@ -586,9 +853,14 @@ func (c *incomingConn) reader() {
 				TopicsQos: make([]proto.QosLevel, len(m.Topics)),
 			}
 			for i, tq := range m.Topics {
-				// TODO: Handle varying QoS correctly
+				// QoS 2 is downgraded to QoS 1
+				qos := tq.Qos
+				if qos > proto.QosAtLeastOnce {
+					qos = proto.QosAtLeastOnce
+				}
 				c.svr.subs.add(tq.Topic, c)
-				suback.TopicsQos[i] = proto.QosAtMostOnce
+				c.session.subscribe(tq.Topic, qos)
+				suback.TopicsQos[i] = qos
 			}
 			c.submit(suback)
 
@@ -605,11 +877,17 @@ func (c *incomingConn) reader() {
 			}
 			for _, t := range m.Topics {
 				c.svr.subs.unsub(t, c)
+				c.session.unsubscribe(t)
 			}
 			ack := &proto.UnsubAck{MessageId: m.MessageId}
-			c.submit(ack)
+			// MQTT 5 needs reason code for each topic, 0x00 - success
+			c.submitExtra(ack, &extra{reasons: make([]byte, len(m.Topics))})
 
 		case *proto.Disconnect:
+			// MQTT 5 client can ask to publish the will anyway
+			if x == nil || x.reason != reasonDisconnectWithWill {
+				will = nil
+			}
 			return
 
 		default:
@@ -634,7 +912,7 @@ func (c *incomingConn) writer() {
 		}
 
 		// TODO: write timeout
-		err := job.m.Encode(c.conn)
+		err := encode(c.conn, job.m, c.version, job.x)
 		if job.r != nil {
 			// notifiy the sender that this message is sent
 			close(job.r)
@@ -683,6 +961,12 @@ const (
 	dupTrue                = true
 )
 
+// Match returns true if the topic matches the topic filter, which can
+// contain + and # wildcards.
+func Match(filter, topic string) bool {
+	return newWild(filter, nil).matches(strings.Split(topic, "/"))
+}
+
 func isWildcard(topic string) bool {
 	if strings.Contains(topic, "#") || strings.Contains(topic, "+") {
 		return true
@@ -706,28 +990,37 @@ func (w wild) valid() bool {
 
 const clientQueueLength = 100
 
+// clientTimeout is the default ClientConn.Timeout.
+const clientTimeout = 30 * time.Second
+
 // A ClientConn holds all the state associated with a connection
 // to an MQTT server. It should be allocated via NewClientConn.
 // Concurrent access to a ClientConn is NOT safe.
 type ClientConn struct {
-	Dump     bool                // When true, dump the messages in and out.
-	Incoming chan *proto.Publish // Incoming messages arrive on this channel.
-	id       uint16              // next MessageId
-	out      chan job
-	conn     net.Conn
-	done     chan struct{} // This channel will be readable once a Disconnect has been successfully sent and the connection is closed.
-	connack  chan *proto.ConnAck
-	suback   chan *proto.SubAck
+	Dump      bool                // When true, dump the messages in and out.
+	Incoming  chan *proto.Publish // Incoming messages arrive on this channel.
+	Store     *Store              // Unacknowledged QoS 1 and QoS 2 messages, can be shared with the next connection.
+	Timeout   time.Duration       // Write and CONNACK timeout, defaults to 30 seconds.
+	out       chan job
+	conn      net.Conn
+	done      chan struct{} // This channel will be readable once a Disconnect has been successfully sent and the connection is closed.
+	closed    chan struct{} // This channel will be readable once the reader has exited.
+	connack   chan *proto.ConnAck
+	suback    chan *proto.SubAck
+	version   uint32 // protocol level, set by Connect
+	keepAlive int64  // keepalive interval in ns, set by Connect
 }
 
 // NewClientConn allocates a new ClientConn.
 func NewClientConn(c net.Conn) *ClientConn {
 	cc := &ClientConn{
 		conn:     c,
-		id:       1,
+		Store:    NewStore(),
+		Timeout:  clientTimeout,
 		out:      make(chan job, clientQueueLength),
 		Incoming: make(chan *proto.Publish, clientQueueLength),
 		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
 		connack:  make(chan *proto.ConnAck),
 		suback:   make(chan *proto.SubAck),
 	}
@@ -739,15 +1032,17 @@ func NewClientConn(c net.Conn) *ClientConn {
 func (c *ClientConn) reader() {
 	defer func() {
 		// Cause the writer to exit.
-		close(c.out)
+		close(c.closed)
 		// Cause any goroutines waiting on messages to arrive to exit.
 		close(c.Incoming)
 		c.conn.Close()
 	}()
 
+	// QoS 2 messages delivered to Incoming, but not yet released by server
+	received := make(map[uint16]bool)
+
 	for {
-		// TODO: timeout (first message and/or keepalives)
-		m, err := proto.DecodeOneMessage(c.conn, nil)
+		m, x, err := decode(c.conn, c.getVersion())
 		if err != nil {
 			if err == io.EOF {
 				return
@@ -755,25 +1050,73 @@ func (c *ClientConn) reader() {
 			if strings.HasSuffix(err.Error(), "use of closed network connection") {
 				return
 			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// no PINGRESP or CONNACK, the connection is dead
+				log.Print("cli reader: server is not responding")
+				return
+			}
 			log.Print("cli reader: ", err)
 			return
 		}
 
+		// Server must answer PINGREQ, so the connection is dead if nothing
+		// came in one and a half keepalive intervals.
+		if keepAlive := atomic.LoadInt64(&c.keepAlive); keepAlive > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(time.Duration(keepAlive) * 3 / 2))
+		} else {
+			c.conn.SetReadDeadline(time.Time{})
+		}
+
 		if c.Dump {
 			log.Printf("dump  in: %T", m)
 		}
 
 		switch m := m.(type) {
 		case *proto.Publish:
-			c.Incoming <- m
+			switch m.QosLevel {
+			case proto.QosAtMostOnce:
+				c.Incoming <- m
+			case proto.QosAtLeastOnce:
+				c.Incoming <- m
+				c.send(job{m: &proto.PubAck{MessageId: m.MessageId}})
+			case proto.QosExactlyOnce:
+				// server resends PUBLISH until PUBREC, deliver it only once
+				if !received[m.MessageId] {
+					received[m.MessageId] = true
+					c.Incoming <- m
+				}
+				c.send(job{m: &proto.PubRec{MessageId: m.MessageId}})
+			}
 		case *proto.PubAck:
-			// ignore these
+			if x != nil && x.reason >= 0x80 {
+				log.Printf("cli reader: PUBLISH %v refused, reason 0x%02X %s", m.MessageId, x.reason, x.props.ReasonString)
+			}
+			c.Store.ack(m.MessageId)
+		case *proto.PubRec:
+			if x != nil && x.reason >= 0x80 {
+				// MQTT 5 server refused the message, the flow ends here
+				log.Printf("cli reader: PUBLISH %v refused, reason 0x%02X %s", m.MessageId, x.reason, x.props.ReasonString)
+				c.Store.ack(m.MessageId)
+				continue
+			}
+			c.Store.release(m.MessageId)
+			c.send(job{m: pubrel(m.MessageId)})
+		case *proto.PubRel:
+			delete(received, m.MessageId)
+			c.send(job{m: &proto.PubComp{MessageId: m.MessageId}})
+		case *proto.PubComp:
+			c.Store.ack(m.MessageId)
+		case *proto.PingResp:
+			// read deadline already moved
 			continue
 		case *proto.ConnAck:
 			c.connack <- m
 		case *proto.SubAck:
 			c.suback <- m
 		case *proto.Disconnect:
+			if x != nil && x.reason != 0 {
+				log.Printf("cli reader: disconnected by server, reason 0x%02X %s", x.reason, x.props.ReasonString)
+			}
 			return
 		default:
 			log.Printf("cli reader: got msg type %T", m)
@@ -784,18 +1127,32 @@ func (c *ClientConn) reader() {
 func (c *ClientConn) writer() {
 	// Close connection on exit in order to cause reader to exit.
 	defer func() {
+		c.conn.Close()
 		// Signal to Disconnect() that the message is on its way, or
 		// that the connection is closing one way or the other...
 		close(c.done)
 	}()
 
-	for job := range c.out {
+	// ping is nil (blocks forever) until CONNECT with keepalive was sent
+	var ping <-chan time.Time
+
+	for {
+		var job job
+		select {
+		case job = <-c.out:
+		case <-ping:
+			job.m = &proto.PingReq{}
+		case <-c.closed:
+			return
+		}
+
 		if c.Dump {
 			log.Printf("dump out: %T", job.m)
 		}
 
-		// TODO: write timeout
-		err := job.m.Encode(c.conn)
+		// half-open connection can block write forever
+		c.conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+		err := encode(c.conn, job.m, c.getVersion(), job.x)
 		if job.r != nil {
 			close(job.r)
 		}
@@ -805,7 +1162,14 @@ func (c *ClientConn) writer() {
 			return
 		}
 
-		if _, ok := job.m.(*proto.Disconnect); ok {
+		switch m := job.m.(type) {
+		case *proto.Connect:
+			if m.KeepAliveTimer > 0 {
+				ticker := time.NewTicker(time.Duration(m.KeepAliveTimer) * time.Second)
+				defer ticker.Stop()
+				ping = ticker.C
+			}
+		case *proto.Disconnect:
 			return
 		}
 	}
@@ -813,14 +1177,17 @@ func (c *ClientConn) writer() {
 
 // Connect sends the CONNECT message to the server. If the ClientId is not already
 // set, use a default (a 63-bit decimal random number). The "clean session"
-// bit is always set.
+// bit is always set. If KeepAliveTimer is set, PINGREQ is sent with this interval.
+// ProtocolVersion selects MQTT 3.1, 3.1.1 (default) or 5.
 func (c *ClientConn) Connect(m *proto.Connect) error {
-	// TODO: Keepalive timer
 	if m.ClientId == "" {
 		m.ClientId = fmt.Sprint(cliRand.Int63())
 	}
-	m.ProtocolName = "MQIsdp"
-	m.ProtocolVersion = 3
+	if m.ProtocolVersion == 0 {
+		m.ProtocolVersion = Version311
+	}
+	m.ProtocolName = protocolName(m.ProtocolVersion)
+	atomic.StoreUint32(&c.version, uint32(m.ProtocolVersion))
 
 	if m.Username != "" {
 		m.UsernameFlag = true
@@ -831,9 +1198,25 @@ func (c *ClientConn) Connect(m *proto.Connect) error {
 		m.WillFlag = true
 	}
 
+	atomic.StoreInt64(&c.keepAlive, int64(m.KeepAliveTimer)*int64(time.Second))
+
+	// reader closes the connection if CONNACK doesn't come in time
+	c.conn.SetReadDeadline(time.Now().Add(c.Timeout))
+
 	c.sync(m)
-	ack := <-c.connack
-	return ConnectionErrors[ack.ReturnCode]
+	select {
+	case ack := <-c.connack:
+		if err := connectError(ack.ReturnCode); err != nil {
+			return err
+		}
+		// resend unacknowledged messages before any new ones
+		for _, m := range c.Store.pending() {
+			c.send(job{m: m})
+		}
+		return nil
+	case <-c.done:
+		return errors.New("Connection closed")
+	}
 }
 
 // ConnectionErrors is an array of errors corresponding to the
@@ -855,38 +1238,59 @@ func (c *ClientConn) Disconnect() {
 	<-c.done
 }
 
-func (c *ClientConn) nextid() uint16 {
-	id := c.id
-	c.id++
-	return id
-}
-
 // Subscribe subscribes this connection to a list of topics. Messages
 // will be delivered on the Incoming channel.
 func (c *ClientConn) Subscribe(tqs []proto.TopicQos) *proto.SubAck {
 	c.sync(&proto.Subscribe{
 		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
-		MessageId: c.nextid(),
+		MessageId: c.Store.nextID(),
 		Topics:    tqs,
 	})
-	ack := <-c.suback
-	return ack
+	select {
+	case ack := <-c.suback:
+		return ack
+	case <-c.done:
+		return nil
+	}
 }
 
-// Publish publishes the given message to the MQTT server.
-// The QosLevel of the message must be QosAtLeastOnce for now.
+func (c *ClientConn) getVersion() byte {
+	return byte(atomic.LoadUint32(&c.version))
+}
+
+// Publish publishes the given message to the MQTT server. QoS 1 and QoS 2
+// messages get MessageId and stay in the Store until acknowledged.
 func (c *ClientConn) Publish(m *proto.Publish) {
-	if m.QosLevel != proto.QosAtMostOnce {
+	switch m.QosLevel {
+	case proto.QosAtMostOnce:
+	case proto.QosAtLeastOnce, proto.QosExactlyOnce:
+		c.Store.add(m)
+	default:
 		panic("unsupported QoS level")
 	}
-	m.MessageId = c.nextid()
-	c.out <- job{m: m}
+	c.send(job{m: m})
+}
+
+// send queues a job, it returns false if the connection is already closed.
+func (c *ClientConn) send(j job) bool {
+	select {
+	case c.out <- j:
+		return true
+	case <-c.closed:
+	case <-c.done:
+	}
+	return false
 }
 
-// sync sends a message and blocks until it was actually sent.
+// sync sends a message and blocks until it was actually sent
+// or the connection is closed.
 func (c *ClientConn) sync(m proto.Message) {
 	j := job{m: m, r: make(receipt)}
-	c.out <- j
-	<-j.r
-	return
+	if !c.send(j) {
+		return
+	}
+	select {
+	case <-j.r:
+	case <-c.done:
+	}
 }
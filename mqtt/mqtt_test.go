@@ -0,0 +1,75 @@
+package mqtt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWildMatches(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"gw3/+/state", "gw3/AA:BB/state", true},
+		{"gw3/+/state", "gw3/AA:BB/event", false},
+		{"gw3/+/state", "gw3/state", false},
+		{"gw3/+/state", "gw3/AA:BB/state/x", false},
+		{"gw3/#", "gw3/AA:BB/state", true},
+		{"gw3/#", "gw3", true}, // # also matches the parent level
+		{"gw3/#", "gw4/AA:BB/state", false},
+		{"#", "gw3/AA:BB/state", true},
+		{"+", "gw3", true},
+		{"+", "gw3/state", false},
+		{"+/+", "/gw3", true}, // empty level
+		{"gw3/+", "gw3/", true},
+		{"gw3", "gw3", true},
+		{"gw3", "gw3/state", false},
+
+		// wildcards at the first level don't match $ topics
+		{"#", "$SYS/broker/clients/active", false},
+		{"+/broker/#", "$SYS/broker/clients/active", false},
+		{"$SYS/#", "$SYS/broker/clients/active", true},
+		{"$SYS/+/clients/+", "$SYS/broker/clients/active", true},
+		{"gw3/#", "gw3/$info", true},
+	}
+	for _, test := range tests {
+		w := newWild(test.filter, nil)
+		if got := w.matches(strings.Split(test.topic, "/")); got != test.want {
+			t.Errorf("%q matches %q = %v, want %v", test.filter, test.topic, got, test.want)
+		}
+	}
+}
+
+func TestWildValid(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{"gw3/+/state", true},
+		{"gw3/#", true},
+		{"#", true},
+		{"gw3/#/state", false},
+		{"gw3#", false},
+		{"gw3/st+te", false},
+	}
+	for _, test := range tests {
+		if got := newWild(test.filter, nil).valid(); got != test.want {
+			t.Errorf("%q valid = %v, want %v", test.filter, got, test.want)
+		}
+	}
+}
+
+func TestSubscriptionsAdd(t *testing.T) {
+	s := newSubscriptions(0)
+	c1, c2 := &incomingConn{}, &incomingConn{}
+
+	// restored session and repeated SUBSCRIBE add the same topics again
+	for _, c := range []*incomingConn{c1, c1, c2} {
+		s.add("gw3/AA:BB/state", c)
+		s.add("gw3/+/state", c)
+	}
+
+	if got := len(s.subscribers("gw3/AA:BB/state")); got != 4 {
+		t.Errorf("subscribers = %d, want 4", got)
+	}
+}
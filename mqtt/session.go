@@ -0,0 +1,237 @@
+package mqtt
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// The maximum number of QoS 1 messages sent to a client and not yet
+// acknowledged, the next messages wait in the session queue.
+const sessionInflight = 100
+
+// sessionQueue is the default Server.QueueLength.
+const sessionQueue = 1000
+
+// A session holds the state of a client which lives between connections,
+// when the client connects without clean session flag. Clean session lives
+// while the connection lives.
+type session struct {
+	clientid string
+	limit    int           // maximum length of the queue
+	auth     Authenticator // checks access of offline client
+
+	mu         sync.Mutex // guards access to fields below
+	username   string
+	persistent bool
+	expiry     time.Duration             // lifetime after disconnect, 0 - forever
+	offlineAt  time.Time                 // time of the last disconnect
+	conn       *incomingConn             // nil while the client is offline
+	subs       map[string]proto.QosLevel // topic filter - granted QoS
+	store      *Store                    // QoS 1 messages sent to the client
+	queue      []*proto.Publish          // QoS 1 messages waiting for sending
+	dropped    int
+}
+
+func newSession(c *incomingConn, persistent bool, expiry time.Duration) *session {
+	limit := c.svr.QueueLength
+	if limit <= 0 {
+		limit = sessionQueue
+	}
+	return &session{
+		clientid:   c.clientid,
+		limit:      limit,
+		auth:       c.svr.Auth,
+		username:   c.username,
+		persistent: persistent,
+		expiry:     expiry,
+		subs:       make(map[string]proto.QosLevel),
+		store:      NewStore(),
+	}
+}
+
+// update changes the session for the new connection of the same client.
+func (s *session) update(c *incomingConn, persistent bool, expiry time.Duration) {
+	s.mu.Lock()
+	s.username = c.username
+	s.persistent = persistent
+	s.expiry = expiry
+	s.mu.Unlock()
+}
+
+// expired returns true if the client is offline longer than MQTT 5 session
+// expiry interval.
+func (s *session) expired(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn == nil && s.expiry > 0 && now.Sub(s.offlineAt) >= s.expiry
+}
+
+// allowed checks read access of the offline client to the topic.
+func (s *session) allowed(topic string) bool {
+	s.mu.Lock()
+	username := s.username
+	s.mu.Unlock()
+	return s.auth == nil || s.auth.Allow(username, s.clientid, topic, false)
+}
+
+// isPersistent returns true if the session lives after disconnect.
+func (s *session) isPersistent() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.persistent
+}
+
+// subscribe remembers the granted QoS of the topic filter.
+func (s *session) subscribe(topic string, qos proto.QosLevel) {
+	s.mu.Lock()
+	s.subs[topic] = qos
+	s.mu.Unlock()
+}
+
+func (s *session) unsubscribe(topic string) {
+	s.mu.Lock()
+	delete(s.subs, topic)
+	s.mu.Unlock()
+}
+
+// topics returns the copy of subscriptions for restoring them in the new
+// connection.
+func (s *session) topics() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	topics := make([]string, 0, len(s.subs))
+	for topic := range s.subs {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// qos returns the maximum granted QoS of subscriptions matching the topic.
+func (s *session) qos(topic string) proto.QosLevel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	qos := proto.QosAtMostOnce
+	for filter, q := range s.subs {
+		if q > qos && Match(filter, topic) {
+			qos = q
+		}
+	}
+	return qos
+}
+
+// attach binds the new connection to the session and sends messages which
+// were not acknowledged in the previous connection or were queued while
+// the client was offline.
+func (s *session) attach(c *incomingConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn = c
+
+	// messages which don't fit to the connection queue go back to the
+	// session queue in the same order
+	var requeue []*proto.Publish
+	for _, m := range s.store.pending() {
+		// the server sends only QoS 1 messages, so there are no PUBREL
+		p := m.(*proto.Publish)
+		if requeue == nil && c.submit(p) {
+			continue
+		}
+		s.store.ack(p.MessageId)
+		p.DupFlag = false
+		requeue = append(requeue, p)
+	}
+	s.queue = append(requeue, s.queue...)
+
+	s.sendQueue()
+}
+
+// detach unbinds the connection, if it wasn't replaced by the new one.
+func (s *session) detach(c *incomingConn) {
+	s.mu.Lock()
+	if s.conn == c {
+		s.conn = nil
+		s.offlineAt = time.Now()
+	}
+	s.mu.Unlock()
+}
+
+// online returns true if the client is connected.
+func (s *session) online() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn != nil
+}
+
+// deliver sends a copy of QoS 1 message to the client, or puts it to the
+// queue while the client is offline or has too many unacknowledged messages.
+func (s *session) deliver(m *proto.Publish) {
+	msg := *m
+	msg.Header = header(dupFalse, proto.QosAtLeastOnce, retainFlag(m.Retain))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) >= s.limit {
+		s.dropExpired()
+	}
+	if len(s.queue) >= s.limit {
+		s.queue = s.queue[1:]
+		s.dropped++
+		if s.dropped == 1 || s.dropped%100 == 0 {
+			log.Printf("session %v: dropped %v queued messages", s.clientid, s.dropped)
+		}
+	}
+	s.queue = append(s.queue, &msg)
+	s.sendQueue()
+}
+
+// ack removes the message acknowledged by the client and sends the next
+// messages from the queue.
+func (s *session) ack(id uint16) {
+	s.store.ack(id)
+
+	s.mu.Lock()
+	s.sendQueue()
+	s.mu.Unlock()
+}
+
+// sendQueue should be called with mu locked. Messages which don't fit to the
+// connection queue stay in the session queue until the next PUBACK, the next
+// message or reconnect.
+func (s *session) sendQueue() {
+	if s.conn == nil {
+		return
+	}
+	for len(s.queue) > 0 && s.store.Len() < sessionInflight {
+		m := s.queue[0]
+		if expired(m) {
+			s.queue = s.queue[1:]
+			continue
+		}
+		// the message is kept in the store until PUBACK
+		s.store.add(m)
+		if !s.conn.submit(m) {
+			s.store.ack(m.MessageId)
+			return
+		}
+		s.queue = s.queue[1:]
+	}
+}
+
+// dropExpired removes messages with passed MQTT 5 message expiry interval
+// from the queue, should be called with mu locked.
+func (s *session) dropExpired() {
+	queue := s.queue[:0]
+	for _, m := range s.queue {
+		if !expired(m) {
+			queue = append(queue, m)
+		}
+	}
+	for i := len(queue); i < len(s.queue); i++ {
+		s.queue[i] = nil
+	}
+	s.queue = queue
+}
@@ -0,0 +1,125 @@
+package mqtt
+
+import (
+	"log"
+	"sync"
+
+	proto "github.com/huin/mqtt"
+)
+
+// The maximum number of unacknowledged messages kept by a Store, the oldest
+// message is dropped when the limit is reached.
+const storeLimit = 1000
+
+// A Store keeps outgoing QoS 1 and QoS 2 messages until they are
+// acknowledged. It can be shared by successive ClientConns of one client,
+// so unacknowledged messages are sent again after reconnect. It is safe
+// for concurrent use.
+type Store struct {
+	mu       sync.Mutex
+	id       uint16 // last MessageId
+	inflight []*inflight
+}
+
+type inflight struct {
+	m        proto.Publish // a copy, so DUP flag doesn't change the original
+	released bool          // PUBREC received, PUBCOMP is expected
+}
+
+// NewStore allocates a new Store.
+func NewStore() *Store {
+	return &Store{}
+}
+
+// Len returns the number of unacknowledged messages.
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.inflight)
+}
+
+// nextID returns a MessageId which is not zero and not in flight.
+func (s *Store) nextID() uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nextIDLocked()
+}
+
+func (s *Store) nextIDLocked() uint16 {
+	for {
+		s.id++
+		if s.id != 0 && s.find(s.id) < 0 {
+			return s.id
+		}
+	}
+}
+
+func (s *Store) find(id uint16) int {
+	for i, f := range s.inflight {
+		if f.m.MessageId == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// add sets MessageId of the message and keeps a copy of it.
+func (s *Store) add(m *proto.Publish) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.inflight) >= storeLimit {
+		log.Print("store: dropped unacknowledged message ", s.inflight[0].m.TopicName)
+		s.inflight = s.inflight[1:]
+	}
+
+	m.MessageId = s.nextIDLocked()
+	s.inflight = append(s.inflight, &inflight{m: *m})
+}
+
+// release marks QoS 2 message as received by the server. It returns false
+// for unknown MessageId.
+func (s *Store) release(id uint16) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i := s.find(id); i >= 0 {
+		s.inflight[i].released = true
+		return true
+	}
+	return false
+}
+
+// ack removes the message from the store when delivery is complete.
+func (s *Store) ack(id uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i := s.find(id); i >= 0 {
+		s.inflight = append(s.inflight[:i], s.inflight[i+1:]...)
+	}
+}
+
+// pending returns messages for resending in the original order: PUBLISH
+// with DUP flag or PUBREL for released QoS 2 messages.
+func (s *Store) pending() []proto.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msgs := make([]proto.Message, 0, len(s.inflight))
+	for _, f := range s.inflight {
+		if f.released {
+			msgs = append(msgs, pubrel(f.m.MessageId))
+		} else {
+			m := f.m
+			m.DupFlag = true
+			msgs = append(msgs, &m)
+		}
+	}
+	return msgs
+}
+
+func pubrel(id uint16) *proto.PubRel {
+	return &proto.PubRel{
+		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		MessageId: id,
+	}
+}
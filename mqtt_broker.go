@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/AlexxIT/gw3/mqtt"
+	"github.com/rs/zerolog/log"
+	"net"
+	"strings"
+	"time"
+)
+
+// embedded broker, nil if disabled
+var mqttServer *mqtt.Server
+
+// mqttRunBroker replaces firmware mosquitto with embedded broker, it returns
+// false if broker is disabled, auth files are broken or it can't listen,
+// so mosquitto should be used
+func mqttRunBroker() bool {
+	if config.Broker == nil || !config.Broker.Enabled {
+		return false
+	}
+
+	listen := config.Broker.Listen
+	if listen == "" {
+		listen = ":1883"
+	}
+
+	var auth *mqtt.FileAuth
+	if config.Broker.PasswordFile != "" || config.Broker.ACLFile != "" {
+		var err error
+		if auth, err = mqtt.NewFileAuth(config.Broker.PasswordFile, config.Broker.ACLFile); err != nil {
+			log.Error().Err(err).Msg("Can't load MQTT broker auth")
+			return false
+		}
+	}
+
+	log.Debug().Str("listen", listen).Msg("Run embedded MQTT broker")
+
+	// free the port
+	shellKillall("mosquitto")
+
+	time.Sleep(time.Second)
+
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.Error().Err(err).Msg("Can't run embedded MQTT broker")
+		return false
+	}
+
+	mqttServer = mqtt.NewServer(l)
+	if auth != nil {
+		mqttServer.Auth = auth
+	}
+	mqttServer.QueueLength = config.Broker.Queue
+	mqttServer.Start()
+
+	return true
+}
+
+// mqttDialBroker connects to embedded broker in-process without TCP
+func mqttDialBroker() net.Conn {
+	client, server := net.Pipe()
+	mqttServer.ServeConn(server)
+	return client
+}
+
+// mqttPasswordLine returns "username:hash" from "username:password"
+func mqttPasswordLine(s string) string {
+	i := strings.IndexByte(s, ':')
+	if i <= 0 {
+		return "wrong format, should be username:password"
+	}
+	return s[:i] + ":" + mqtt.HashPassword(s[i+1:])
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"github.com/AlexxIT/gw3/gap"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// Home Assistant MQTT discovery
+// https://www.home-assistant.io/docs/mqtt/discovery/
+
+// hassEntity: component, device_class, unit_of_measurement, state_class
+var hassEntities = map[string][4]string{
+	"battery":      {"sensor", "battery", "%", "measurement"},
+	"co2":          {"sensor", "carbon_dioxide", "ppm", "measurement"},
+	"conductivity": {"sensor", "", "µS/cm", "measurement"},
+	"energy":       {"sensor", "energy", "kWh", "total_increasing"},
+	"formaldehyde": {"sensor", "", "mg/m³", "measurement"},
+	"humidity":     {"sensor", "humidity", "%", "measurement"},
+	"idle_time":    {"sensor", "duration", "s", "measurement"},
+	"illuminance":  {"sensor", "illuminance", "lx", "measurement"},
+	"moisture":     {"sensor", "moisture", "%", "measurement"},
+	"pm10":         {"sensor", "pm10", "µg/m³", "measurement"},
+	"pm25":         {"sensor", "pm25", "µg/m³", "measurement"},
+	"pressure":     {"sensor", "pressure", "hPa", "measurement"},
+	"rssi":         {"sensor", "signal_strength", "dBm", "measurement"},
+	"supply":       {"sensor", "", "%", "measurement"},
+	"temperature":  {"sensor", "temperature", "°C", "measurement"},
+	"tvoc":         {"sensor", "volatile_organic_compounds", "µg/m³", "measurement"},
+	"voltage":      {"sensor", "voltage", "mV", "measurement"},
+
+	"battery_low": {"binary_sensor", "battery", "", ""},
+	"contact":     {"binary_sensor", "door", "", ""},
+	"door":        {"binary_sensor", "door", "", ""},
+	"gas":         {"binary_sensor", "gas", "", ""},
+	"light":       {"binary_sensor", "light", "", ""},
+	"lock":        {"binary_sensor", "lock", "", ""},
+	"motion":      {"binary_sensor", "motion", "", ""},
+	"occupancy":   {"binary_sensor", "occupancy", "", ""},
+	"opening":     {"binary_sensor", "opening", "", ""},
+	"presence":    {"binary_sensor", "presence", "", ""},
+	"problem":     {"binary_sensor", "problem", "", ""},
+	"smoke":       {"binary_sensor", "smoke", "", ""},
+	"tamper":      {"binary_sensor", "tamper", "", ""},
+	"vibration":   {"binary_sensor", "vibration", "", ""},
+	"water_leak":  {"binary_sensor", "moisture", "", ""},
+	"window":      {"binary_sensor", "window", "", ""},
+}
+
+// state keys without entities
+var hassSkip = map[string]bool{"seq": true, "last_seen": true}
+
+// incremented on each MQTT connection from MQTT goroutine, use atomic
+var hassSession int32
+
+var hassReplacer = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// hassObjectID converts MAC or tracker ID to valid discovery topic part
+func hassObjectID(id string) string {
+	return strings.ToLower(hassReplacer.ReplaceAllString(id, ""))
+}
+
+func hassPublishConfig(component string, objectID string, payload map[string]interface{}) {
+	if config.Discovery == "" {
+		return
+	}
+	mqttPublish(config.Discovery+"/"+component+"/"+objectID+"/config", payload, true)
+}
+
+// hassPublishBLE publishes one entity per state key, only for new keys
+func hassPublishBLE(d *BLEDevice) {
+	if config.Discovery == "" {
+		return
+	}
+
+	// republish all entities after reconnect, because broker may lose retained messages after restart
+	session := atomic.LoadInt32(&hassSession)
+	if d.discovered == nil || d.discoveredSession != session {
+		d.discovered = make(map[string]bool)
+		d.discoveredSession = session
+	}
+
+	for key := range d.state {
+		if d.discovered[key] || hassSkip[key] {
+			continue
+		}
+		d.discovered[key] = true
+
+		objectID := hassObjectID(d.MAC) + "_" + key
+
+		payload := map[string]interface{}{
+			"name":           d.Name + " " + strings.ReplaceAll(key, "_", " "),
+			"unique_id":      objectID,
+			"state_topic":    mqttTopic(d.MAC, "state"),
+			"value_template": "{{ value_json." + key + " }}",
+			"device": map[string]interface{}{
+				"identifiers":  []string{d.MAC},
+				"name":         d.Brand + " " + d.Name,
+				"manufacturer": d.Brand,
+				"model":        d.Model,
+				"via_device":   gw.WiFi.MAC,
+			},
+		}
+
+		component := "sensor"
+		if entity, ok := hassEntities[key]; ok {
+			component = entity[0]
+			if entity[1] != "" {
+				payload["device_class"] = entity[1]
+			}
+			if entity[2] != "" {
+				payload["unit_of_measurement"] = entity[2]
+			}
+			if entity[3] != "" {
+				payload["state_class"] = entity[3]
+			}
+		} else if unit := gap.MiotUnit(key); unit != "" {
+			payload["unit_of_measurement"] = unit
+			payload["state_class"] = "measurement"
+		}
+
+		if config.GetTimeout(d.MAC, d.Model) > 0 {
+			payload["availability_topic"] = mqttTopic(d.MAC, "availability")
+		}
+
+		if component == "binary_sensor" {
+			// 1 => on, same for all binary states
+			payload["payload_on"] = "1"
+			payload["payload_off"] = "0"
+		}
+
+		hassPublishConfig(component, objectID, payload)
+	}
+}
+
+// hassPublishGateway publishes alarm, buzzer and connectivity entities
+func hassPublishGateway(d *GatewayDevice) {
+	if config.Discovery == "" {
+		return
+	}
+
+	mac := d.WiFi.MAC
+	objectID := hassObjectID(mac)
+
+	device := map[string]interface{}{
+		"identifiers":  []string{mac},
+		"connections":  [][2]string{{"mac", mac}},
+		"name":         "Xiaomi Gateway 3",
+		"manufacturer": "Xiaomi",
+		"model":        "ZNDMWG03LM",
+		"sw_version":   d.FwVersion,
+	}
+
+	hassPublishConfig("alarm_control_panel", objectID+"_alarm", map[string]interface{}{
+		"name":              "Gateway alarm",
+		"unique_id":         objectID + "_alarm",
+		"state_topic":       mqttTopic(mac, "state"),
+		"value_template":    "{{ value_json.alarm_state }}",
+		"command_topic":     mqttTopic(mac, "set"),
+		"payload_disarm":    `{"alarm_state":"disarmed"}`,
+		"payload_arm_home":  `{"alarm_state":"armed_home"}`,
+		"payload_arm_away":  `{"alarm_state":"armed_away"}`,
+		"payload_arm_night": `{"alarm_state":"armed_night"}`,
+		"payload_trigger":   `{"alarm_state":"triggered"}`,
+		"code_arm_required": false,
+		"device":            device,
+	})
+
+	hassPublishConfig("switch", objectID+"_buzzer", map[string]interface{}{
+		"name":          "Gateway buzzer",
+		"unique_id":     objectID + "_buzzer",
+		"command_topic": mqttTopic(mac, "set"),
+		"payload_on":    `{"buzzer":"ON"}`,
+		"payload_off":   `{"buzzer":"OFF"}`,
+		"optimistic":    true,
+		"device":        device,
+	})
+
+	hassPublishConfig("binary_sensor", objectID+"_connectivity", map[string]interface{}{
+		"name":           "Gateway connectivity",
+		"unique_id":      objectID + "_connectivity",
+		"state_topic":    mqttTopic(mac, "state"),
+		"value_template": "{{ 'OFF' if value_json.state == 'offline' else 'ON' }}",
+		"device_class":   "connectivity",
+		"device":         device,
+	})
+}
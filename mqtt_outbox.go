@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// mqttMessage - message published while MQTT is disconnected
+type mqttMessage struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	Retain  bool   `json:"retain,omitempty"`
+}
+
+// mqttOutbox keeps messages until reconnect. Retained messages are coalesced
+// per topic (only last state is needed), other messages keep their order.
+type mqttOutbox struct {
+	messages []*mqttMessage
+	retained map[string]*mqttMessage
+	dropped  int // since start, the oldest message is dropped when outbox is full
+	saveNext time.Time
+}
+
+// guards mqttClient and outbox, so no message is lost between flush and connect
+var mqttMu sync.Mutex
+var outbox = &mqttOutbox{retained: make(map[string]*mqttMessage)}
+
+// mqttOutboxConfig returns outbox size and file path, empty path - memory only
+func mqttOutboxConfig() (size int, path string, interval time.Duration) {
+	size, interval = 1000, 10*time.Second
+	if o := config.broker.Outbox; o != nil {
+		if o.Size > 0 {
+			size = o.Size
+		}
+		if o.Interval > 0 {
+			interval = time.Duration(o.Interval) * time.Second
+		}
+		path = o.Path
+	}
+	return
+}
+
+// add should be called with mqttMu locked, it returns error of file write
+func (o *mqttOutbox) add(topic string, payload []byte, retain bool) error {
+	if retain {
+		if msg, ok := o.retained[topic]; ok {
+			msg.Payload = string(payload)
+			return o.save(false)
+		}
+	}
+
+	size, _, _ := mqttOutboxConfig()
+	for len(o.messages) >= size {
+		if msg := o.messages[0]; msg.Retain {
+			delete(o.retained, msg.Topic)
+		}
+		o.messages = o.messages[1:]
+		o.dropped++
+	}
+
+	msg := &mqttMessage{Topic: topic, Payload: string(payload), Retain: retain}
+	o.messages = append(o.messages, msg)
+	if retain {
+		o.retained[topic] = msg
+	}
+
+	return o.save(false)
+}
+
+// flush should be called with mqttMu locked, it returns messages in order
+// and clears outbox
+func (o *mqttOutbox) flush() ([]*mqttMessage, error) {
+	messages := o.messages
+	o.messages = nil
+	o.retained = make(map[string]*mqttMessage)
+	return messages, o.save(true)
+}
+
+// save writes outbox to file not more than once per interval,
+// force is used for writing empty outbox after flush
+func (o *mqttOutbox) save(force bool) error {
+	_, path, interval := mqttOutboxConfig()
+	if path == "" {
+		return nil
+	}
+
+	now := time.Now()
+	if !force && now.Before(o.saveNext) {
+		return nil
+	}
+	o.saveNext = now.Add(interval)
+
+	if len(o.messages) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(o.messages)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+// mqttRestoreOutbox loads messages which were not sent before app restart,
+// should be called before first publish
+func mqttRestoreOutbox() {
+	_, path, _ := mqttOutboxConfig()
+	if path == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn().Err(err).Send()
+		}
+		return
+	}
+
+	var messages []*mqttMessage
+	if err = json.Unmarshal(data, &messages); err != nil {
+		log.Warn().Err(err).Msg("Can't restore MQTT outbox")
+		return
+	}
+
+	mqttMu.Lock()
+	for _, msg := range messages {
+		if msg.Retain {
+			outbox.retained[msg.Topic] = msg
+		}
+	}
+	outbox.messages = messages
+	mqttMu.Unlock()
+
+	log.Info().Int("count", len(messages)).Msg("Restore MQTT outbox")
+}
@@ -2,63 +2,204 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"fmt"
 	"github.com/AlexxIT/gw3/mqtt"
 	proto "github.com/huin/mqtt"
 	"github.com/rs/zerolog/log"
+	"io/ioutil"
 	"net"
+	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 var mqttClient *mqtt.ClientConn
 
+// unacknowledged QoS 1 and QoS 2 messages, they are sent again after reconnect
+var mqttStore = mqtt.NewStore()
+
+// reconnect delay doubles after each failure up to the max value
+const mqttMinDelay, mqttMaxDelay = time.Second, time.Minute
+
 func mqttReader() {
+	version := byte(config.broker.Version)
+	delay := mqttMinDelay
+	reconnects := 0
+
 	for {
-		conn, err := net.Dial("tcp", "127.0.0.1:1883")
+		conn, err := mqttDial(config.broker.URL)
 		if err != nil {
 			log.Error().Caller().Err(err).Send()
 		} else {
-			mqttClient = mqtt.NewClientConn(conn)
-			if err = mqttClient.Connect(&proto.Connect{
-				ClientId: "gw3",
-				WillRetain: true,
-				WillTopic: "gw3/"+gw.WiFi.MAC+"/state",
-				WillMessage: `{"state":"offline"}`,
+			client := mqtt.NewClientConn(conn)
+			client.Store = mqttStore
+			if err = client.Connect(&proto.Connect{
+				ProtocolVersion: version,
+				ClientId:        config.broker.ClientID,
+				Username:        config.broker.Username,
+				Password:        config.broker.Password,
+				KeepAliveTimer:  uint16(config.broker.KeepAlive),
+				WillRetain:      true,
+				WillTopic:       mqttTopic(gw.WiFi.MAC, "state"),
+				WillMessage:     `{"state":"offline"}`,
 			}); err != nil {
-				log.Error().Caller().Err(err).Send()
+				log.Error().Caller().Err(err).Uint8("version", version).Send()
+				// client goroutines exit after connection close
+				_ = conn.Close()
+				// old brokers don't support new protocol, try previous version
+				if err == mqtt.ConnectionErrors[proto.RetCodeUnacceptableProtocolVersion] && version > mqtt.Version31 {
+					version--
+				}
 			} else {
+				// publish only after successful connect, outbox first
+				mqttMu.Lock()
+				messages, err := outbox.flush()
+				for _, msg := range messages {
+					client.Publish(mqttMessagePublish(msg.Topic, []byte(msg.Payload), msg.Retain))
+				}
+				mqttClient = client
+				dropped := outbox.dropped
+				mqttMu.Unlock()
+
+				if err != nil {
+					log.Error().Caller().Err(err).Send()
+				}
+
+				log.Info().Str("url", config.broker.URL).Uint8("version", version).Msg("MQTT connected")
+				connected := time.Now()
+
 				gw.updateInfo()
-				mqttClient.Subscribe([]proto.TopicQos{
-					{Topic: "gw3/+/set"},
+				gw.updateMQTT(reconnects, len(messages), dropped)
+				atomic.AddInt32(&hassSession, 1)
+				topic := mqttTopic("+", "set")
+				client.Subscribe([]proto.TopicQos{
+					{Topic: topic, Qos: config.broker.GetQoS(topic)},
 				})
-				for m := range mqttClient.Incoming {
+				for m := range client.Incoming {
 					buf := bytes.Buffer{}
 					if err = m.Payload.WritePayload(&buf); err != nil {
 						log.Error().Caller().Err(err).Send()
 						continue
 					}
 
-					items := strings.Split(m.TopicName, "/")
-					if len(items) == 3 && items[2] == "set" {
-						mac := items[1]
-						if device, ok := devices[mac]; ok {
+					// prefix may contain slashes, so cut it before split
+					topic := strings.TrimPrefix(m.TopicName, config.broker.Prefix+"/")
+					items := strings.Split(topic, "/")
+					if len(items) == 2 && items[1] == "set" {
+						mac := items[0]
+						if device, ok := getDevice(mac); ok {
 							device.(DeviceGetSet).setState(buf.Bytes())
 						}
 					}
 				}
+
+				mqttMu.Lock()
+				mqttClient = nil
+				mqttMu.Unlock()
+
+				uptime := time.Since(connected)
+				log.Warn().Dur("uptime", uptime).Msg("MQTT disconnected")
+				reconnects++
+
+				// reconnect fast after a long connection
+				if uptime > mqttMaxDelay {
+					delay = mqttMinDelay
+				}
 			}
-			mqttClient = nil
 		}
-		time.Sleep(time.Second)
+
+		time.Sleep(delay)
+		if delay *= 2; delay > mqttMaxDelay {
+			delay = mqttMaxDelay
+		}
 	}
 }
 
-func mqttPublish(topic string, data interface{}, retain bool) {
-	if mqttClient == nil {
-		return
+const mqttDialTimeout = 30 * time.Second
+
+// mqttDial uses embedded broker if it runs, otherwise supports URLs:
+// tcp://host:port, mqtt://host:port, host:port and mqtts://host:port
+// (or ssl://, tls://) with TLS config
+func mqttDial(rawURL string) (net.Conn, error) {
+	if mqttServer != nil {
+		return mqttDialBroker(), nil
+	}
+
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "tcp://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
 	}
 
+	host := u.Host
+
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		if u.Port() == "" {
+			host += ":1883"
+		}
+		return net.DialTimeout("tcp", host, mqttDialTimeout)
+
+	case "mqtts", "ssl", "tls":
+		if u.Port() == "" {
+			host += ":8883"
+		}
+		tlsConfig, err := mqttTLSConfig(config.broker.TLS)
+		if err != nil {
+			return nil, err
+		}
+		dialer := &net.Dialer{Timeout: mqttDialTimeout}
+		return tls.DialWithDialer(dialer, "tcp", host, tlsConfig)
+	}
+	return nil, fmt.Errorf("unsupported MQTT scheme: %s", u.Scheme)
+}
+
+// mqttTLSConfig loads files on each connect, so renewed certificates are used
+// after reconnect, empty config uses system CAs
+func mqttTLSConfig(c *ConfigTLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if c == nil {
+		return tlsConfig, nil
+	}
+
+	tlsConfig.ServerName = c.ServerName
+	tlsConfig.InsecureSkipVerify = c.Insecure
+
+	if c.CA != "" {
+		data, err := ioutil.ReadFile(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in CA file: %s", c.CA)
+		}
+	}
+
+	if c.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// mqttTopic returns device topic with configured prefix: gw3/<mac>/<name>
+func mqttTopic(mac string, name string) string {
+	return config.broker.Prefix + "/" + mac + "/" + name
+}
+
+// mqttPublish sends message or keeps it in outbox while disconnected
+func mqttPublish(topic string, data interface{}, retain bool) {
 	var payload []byte
 
 	switch data.(type) {
@@ -78,25 +219,41 @@ func mqttPublish(topic string, data interface{}, retain bool) {
 	//topic = re.ReplaceAllString(topic, `$1:FF:FF:FF`)
 	//payload = re.ReplaceAll(payload, []byte(`$1:FF:FF:FF`))
 
-	msg := &proto.Publish{
-		Header:    proto.Header{Retain: retain},
+	mqttMu.Lock()
+	if mqttClient != nil {
+		mqttClient.Publish(mqttMessagePublish(topic, payload, retain))
+		mqttMu.Unlock()
+		return
+	}
+	err := outbox.add(topic, payload, retain)
+	mqttMu.Unlock()
+
+	// log after unlock, because log can be written to MQTT
+	if err != nil {
+		log.Error().Caller().Err(err).Send()
+	}
+}
+
+func mqttMessagePublish(topic string, payload []byte, retain bool) *proto.Publish {
+	return &proto.Publish{
+		Header:    proto.Header{Retain: retain, QosLevel: config.broker.GetQoS(topic)},
 		TopicName: topic,
 		Payload:   proto.BytesPayload(payload),
 	}
-	mqttClient.Publish(msg)
 }
 
 type mqttLogWriter struct{}
 
 func (m mqttLogWriter) Write(p []byte) (n int, err error) {
+	// logs are not kept in outbox, they would push out useful messages
+	mqttMu.Lock()
 	if mqttClient != nil {
-		msg := &proto.Publish{
-			Header:    proto.Header{},
-			TopicName: "gw3/stdout",
-			Payload:   proto.BytesPayload(p),
-		}
-		mqttClient.Publish(msg)
+		// logger reuses buffer after Write, but publish is async
+		payload := make([]byte, len(p))
+		copy(payload, p)
+		mqttClient.Publish(mqttMessagePublish(config.broker.Prefix+"/stdout", payload, false))
 	}
+	mqttMu.Unlock()
 
 	return len(p), nil
 }
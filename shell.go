@@ -170,3 +170,11 @@ func shellPatchApp(filename string) bool {
 
 	return true
 }
+
+// writeFileAtomic writes to temp file and renames it, so file will not be broken on reboot
+func writeFileAtomic(path string, data []byte) error {
+	if err := ioutil.WriteFile(path+".tmp", data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}